@@ -0,0 +1,98 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Backup 在数据库运行期间把数据备份到 destDir，备份出的目录可以直接 Open
+func (db *DB) Backup(destDir string) error {
+	// 和 merge 一样，先持久化并封存当前活跃文件，之后的写入都落在新的活跃文件上
+	// 封存之后的旧数据文件不会再被修改，这时候再慢慢复制就不会影响读写
+	//
+	// 旧数据文件尽量用硬链接，最新的那个文件会作为备份的活跃文件继续写入，
+	// 所以必须复制一份，否则会改到原数据库的文件
+	// hint 索引与 merge 完成标识一起复制，文件锁不复制，
+	// B+树索引文件也不复制，打开备份时会从数据文件重建
+
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.options.InMemory {
+		return ErrInMemory
+	}
+
+	if err := os.MkdirAll(destDir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 0 {
+		return ErrBackupDirNotEmpty
+	}
+
+	db.mu.Lock()
+	if db.activeFile == nil {
+		db.mu.Unlock()
+		return nil
+	}
+	if err := db.rotateActiveFile(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+
+	var fileIds []int
+	for fid := range db.olderFiles {
+		fileIds = append(fileIds, int(fid))
+	}
+	db.mu.Unlock()
+
+	sort.Ints(fileIds)
+
+	for i, fid := range fileIds {
+		srcPath := data.GetDataFileName(db.options.DirPath, uint32(fid))
+		destPath := data.GetDataFileName(destDir, uint32(fid))
+		if i == len(fileIds)-1 {
+			if err := utils.CopyFile(srcPath, destPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := linkOrCopyFile(srcPath, destPath); err != nil {
+			return err
+		}
+
+		// 封存文件的 hint 同样不会再被修改
+		hintPath := data.GetFileHintName(db.options.DirPath, uint32(fid))
+		if _, err := os.Stat(hintPath); err == nil {
+			if err := linkOrCopyFile(hintPath, data.GetFileHintName(destDir, uint32(fid))); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, fileName := range []string{data.HintFileName, data.MergeFinishedFileName} {
+		srcPath := filepath.Join(db.options.DirPath, fileName)
+		if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+			continue
+		}
+		if err := utils.CopyFile(srcPath, filepath.Join(destDir, fileName)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// linkOrCopyFile 不在同一个文件系统上时无法硬链接，退而复制
+func linkOrCopyFile(srcPath, destPath string) error {
+	if err := os.Link(srcPath, destPath); err != nil {
+		return utils.CopyFile(srcPath, destPath)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package bitcask_go
+
+import (
+	"bitcask/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Backup(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 300000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dest")
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+
+	// 备份之后的写入不影响备份
+	err = db.Put(utils.GetTestKey(0), utils.RandomValue(128))
+	assert.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(backupDir, fileLockName))
+	assert.True(t, os.IsNotExist(err))
+
+	// 备份目录非空
+	err = db.Backup(backupDir)
+	assert.Equal(t, ErrBackupDirNotEmpty, err)
+
+	opts2 := opts
+	opts2.DirPath = backupDir
+	db2, err := Open(opts2)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 299000, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 往备份里写入不会影响原数据库
+	err = db2.Put(utils.GetTestKey(1), utils.RandomValue(128))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Backup_BPlusTree(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, wb.Commit())
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-bptree-dest")
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+
+	// 备份里没有索引文件，重放数据文件之后可以继续使用 WriteBatch
+	opts2 := opts
+	opts2.DirPath = backupDir
+	db2, err := Open(opts2)
+	assert.Nil(t, err)
+	assert.Equal(t, db.seqNo, db2.seqNo)
+	wb2 := db2.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb2.Put(utils.GetTestKey(100), []byte("restored")))
+	assert.Nil(t, wb2.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, wb2.Commit())
+	assert.Nil(t, db2.Close())
+
+	// 再次启动时从序列号文件读取
+	db2, err = Open(opts2)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, db.seqNo+1, db2.seqNo)
+	assert.Equal(t, 100, len(db2.ListKeys()))
+	val, err := db2.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("restored"), val)
+	wb2 = db2.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, wb2.Put(utils.GetTestKey(101), []byte("restored")))
+	assert.Nil(t, wb2.Commit())
+}
@@ -2,7 +2,6 @@ package bitcask_go
 
 import (
 	"bitcask/data"
-	"encoding/binary"
 	"sync"
 	"sync/atomic"
 )
@@ -18,9 +17,9 @@ type WriteBatch struct {
 	penddingWrites map[string]*data.LogRecord
 }
 
+// NewWriteBatch 只读模式下返回的 WriteBatch 在 Put、Delete、Commit 时都会返回 ErrReadOnly
 func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
-	// db.isInitial 因为首次启动肯定是没有序列号文件的
-	if db.options.IndexType == BPlusTree && !db.seqFileExists && db.isInitial {
+	if !db.seqNoAvailable() {
 		panic("由于序列号文件不存在，已禁止使用WrtiteBatch功能")
 	}
 	return &WriteBatch{
@@ -35,6 +34,9 @@ func (w *WriteBatch) Put(key, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if w.db.options.ReadOnly {
+		return ErrReadOnly
+	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -54,6 +56,9 @@ func (w *WriteBatch) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if w.db.options.ReadOnly {
+		return ErrReadOnly
+	}
 
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -79,6 +84,9 @@ func (w *WriteBatch) Delete(key []byte) error {
 func (w *WriteBatch) Commit() error {
 	// 两阶段锁实现串行化
 	// 为每条数据添加序列号
+	if w.db.options.ReadOnly {
+		return ErrReadOnly
+	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -89,74 +97,82 @@ func (w *WriteBatch) Commit() error {
 		return ErrExceedMaxBatchNum
 	}
 
-	// 串行化
-	w.db.mu.Lock()
-	defer w.db.mu.Unlock()
-
-	seqNo := atomic.AddUint64(&w.db.seqNo, 1)
-
-	positions := make(map[string]*data.LogRecordPos)
+	records := make([]*data.LogRecord, 0, len(w.penddingWrites))
 	for _, record := range w.penddingWrites {
-		logRecordPos, err := w.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeq(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
-		})
-		if err != nil {
-			return err
-		}
-		positions[string(record.Key)] = logRecordPos
-	}
-
-	// 标识事务结束的数据，用于
-	finLogRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeq(txnFin, seqNo),
-		Type: data.LogRecordTxnFinished,
+		records = append(records, record)
 	}
+	logRecords := txnLogRecords(records, atomic.AddUint64(&w.db.seqNo, 1))
 
-	if _, err := w.db.appendLogRecord(finLogRecord); err != nil {
+	// 和其他并发的写入一起写入、持久化，之后更新索引，同时统计可回收的空间
+	err := w.db.commit(logRecords, w.opts.SyncWrite || w.db.options.SyncWrite, func(positions []*data.LogRecordPos) error {
+		w.db.applyTxnRecords(records, positions)
+		return nil
+	})
+	if err != nil {
 		return err
 	}
 
-	// 持久化
-	if w.opts.SyncWrite && w.db.activeFile != nil {
-		if err := w.db.activeFile.Sync(); err != nil {
-			return err
-		}
+	// 清空
+	w.penddingWrites = make(map[string]*data.LogRecord)
+	return nil
+}
+
+// WriteBatchAvailable 能否使用 WriteBatch 与事务，不能使用时 NewWriteBatch 和 Begin 会 panic
+func (db *DB) WriteBatchAvailable() bool {
+	return db.seqNoAvailable()
+}
+
+// seqNoAvailable B+树模式下启动时不重放数据文件，序列号只能从序列号文件中读取
+// 首次启动肯定是没有序列号文件的，从 0 开始即可；之后没有序列号文件就没法保证序列号不重复
+func (db *DB) seqNoAvailable() bool {
+	return db.options.IndexType != BPlusTree || db.seqFileExists || db.isInitial
+}
+
+// txnLogRecords 给事务中的每条数据加上序列号，最后加上标识事务结束的数据
+// 启动时只有带着结束标识的事务才会生效
+func txnLogRecords(records []*data.LogRecord, seqNo uint64) []*data.LogRecord {
+	logRecords := make([]*data.LogRecord, 0, len(records)+1)
+	for _, record := range records {
+		logRecords = append(logRecords, &data.LogRecord{
+			Key:    logRecordKeyWithSeq(record.Key, seqNo),
+			Value:  record.Value,
+			Type:   record.Type,
+			Expire: record.Expire,
+		})
 	}
+	return append(logRecords, &data.LogRecord{
+		Key:  logRecordKeyWithSeq(txnFin, seqNo),
+		Type: data.LogRecordTxnFinished,
+	})
+}
 
-	// 更新索引
-	for _, record := range w.penddingWrites {
-		pos := positions[string(record.Key)]
+// applyTxnRecords 事务写入之后更新索引，同时统计可回收的空间
+// positions 是 txnLogRecords 生成的数据的位置，最后一个是结束标识
+func (db *DB) applyTxnRecords(records []*data.LogRecord, positions []*data.LogRecordPos) {
+	var reclaimSize = int64(positions[len(records)].Size)
+	for i, record := range records {
+		pos := positions[i]
+		var oldPos *data.LogRecordPos
 		if record.Type == data.LogRecordDeleted {
-			w.db.index.Delete(record.Key)
+			oldPos, _ = db.index.Delete(record.Key)
+			reclaimSize += int64(pos.Size)
 		}
 		if record.Type == data.LogRecordNormal {
-			w.db.index.Put(record.Key, pos)
+			oldPos = db.index.Put(record.Key, pos)
+		}
+		if oldPos != nil {
+			reclaimSize += int64(oldPos.Size)
+			db.evictCache(oldPos)
 		}
 	}
-
-	// 清空
-	w.penddingWrites = make(map[string]*data.LogRecord)
-	return nil
+	atomic.AddInt64(&db.reclaimSize, reclaimSize)
 }
 
 func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
-	seq := make([]byte, binary.MaxVarintLen64)
-	n := binary.PutUvarint(seq[:], seqNo)
-
-	encKey := make([]byte, n+len(key))
-
-	copy(encKey[:n], seq[:n])
-	copy(encKey[n:], key)
-
-	return encKey
+	return data.LogRecordKeyWithSeq(key, seqNo)
 }
 
 // 解析分离出key与seqNo
 func parseLogRecordKey(key []byte) ([]byte, uint64) {
-	seqNo, n := binary.Uvarint(key)
-
-	realKey := key[n:]
-	return realKey, seqNo
+	return data.ParseLogRecordKey(key)
 }
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"bitcask/data"
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// entryOverhead 每个缓存项除 value 之外大致占用的字节数（key、链表节点、map 项）
+const entryOverhead = 64
+
+// posKey 数据在磁盘上的位置，同一位置的数据写入之后不会再变
+type posKey struct {
+	fid    uint32
+	offset int64
+}
+
+type entry struct {
+	key   posKey
+	value []byte
+}
+
+// LRU 按数据位置缓存 value，占用的字节数超过容量时淘汰最久没有访问的数据
+type LRU struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List
+	items    map[posKey]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+// NewLRU capacity 为缓存的总字节数
+func NewLRU(capacity int64) *LRU {
+	return &LRU{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[posKey]*list.Element),
+	}
+}
+
+// Get 返回的 value 是一份拷贝，调用方可以随意修改
+func (c *LRU) Get(pos *data.LogRecordPos) ([]byte, bool) {
+	c.mu.Lock()
+	elem, ok := c.items[posKey{fid: pos.Fid, offset: pos.Offset}]
+	if !ok {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	value := append([]byte(nil), elem.Value.(*entry).value...)
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.hits, 1)
+	return value, true
+}
+
+// Put 缓存 pos 处的 value，会拷贝一份，超过容量的单个 value 不缓存
+func (c *LRU) Put(pos *data.LogRecordPos, value []byte) {
+	cost := int64(len(value)) + entryOverhead
+	if cost > c.capacity {
+		return
+	}
+	key := posKey{fid: pos.Fid, offset: pos.Offset}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&entry{key: key, value: append([]byte(nil), value...)})
+	c.size += cost
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Remove 数据被覆盖或删除之后，旧位置不会再被读到，提前释放空间
+func (c *LRU) Remove(pos *data.LogRecordPos) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[posKey{fid: pos.Fid, offset: pos.Offset}]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// Purge 清空缓存，命中统计保留
+func (c *LRU) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[posKey]*list.Element)
+	c.size = 0
+}
+
+// Size 当前占用的字节数
+func (c *LRU) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Stats 命中与未命中的次数
+func (c *LRU) Stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+func (c *LRU) removeElement(elem *list.Element) {
+	e := c.ll.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	c.size -= int64(len(e.value)) + entryOverhead
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"bitcask/data"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	// 正好放得下两条
+	c := NewLRU(2 * (10 + entryOverhead))
+	pos1 := &data.LogRecordPos{Fid: 1, Offset: 0}
+	pos2 := &data.LogRecordPos{Fid: 1, Offset: 100}
+	pos3 := &data.LogRecordPos{Fid: 2, Offset: 0}
+
+	_, ok := c.Get(pos1)
+	assert.False(t, ok)
+	c.Put(pos1, []byte("value-0001"))
+	c.Put(pos2, []byte("value-0002"))
+	value, ok := c.Get(pos1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value-0001"), value)
+
+	// 返回的是拷贝
+	value[0] = 'x'
+	value, _ = c.Get(pos1)
+	assert.Equal(t, []byte("value-0001"), value)
+
+	// pos2 最久没有访问，被淘汰
+	c.Put(pos3, []byte("value-0003"))
+	_, ok = c.Get(pos2)
+	assert.False(t, ok)
+	_, ok = c.Get(pos1)
+	assert.True(t, ok)
+	_, ok = c.Get(pos3)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2*(10+entryOverhead)), c.Size())
+
+	c.Remove(pos1)
+	_, ok = c.Get(pos1)
+	assert.False(t, ok)
+	assert.Equal(t, int64(10+entryOverhead), c.Size())
+
+	// 超过容量的 value 不缓存
+	c.Put(pos2, make([]byte, 1024))
+	_, ok = c.Get(pos2)
+	assert.False(t, ok)
+
+	c.Purge()
+	assert.Equal(t, int64(0), c.Size())
+	hits, misses := c.Stats()
+	assert.Equal(t, uint64(4), hits)
+	assert.Equal(t, uint64(4), misses)
+}
@@ -0,0 +1,379 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"bitcask/fio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/flock"
+)
+
+// CheckProblemType 检查出来的问题类型
+type CheckProblemType int8
+
+const (
+	ProblemCRCMismatch CheckProblemType = iota + 1 // crc 校验失败或长度损坏，范围到下一条完好的数据为止
+	ProblemTruncated                               // header 或 key/value 不完整，并且之后没有完好的数据
+	ProblemUnreadable                              // crc 正确但解密、解压失败
+	ProblemOrphanedTxn                             // 事务数据没有对应的事务完成标识
+)
+
+func (t CheckProblemType) String() string {
+	switch t {
+	case ProblemCRCMismatch:
+		return "crc mismatch"
+	case ProblemTruncated:
+		return "truncated"
+	case ProblemUnreadable:
+		return "unreadable"
+	case ProblemOrphanedTxn:
+		return "orphaned txn record"
+	}
+	return "unknown"
+}
+
+// CheckProblem 一条有问题的数据
+type CheckProblem struct {
+	Type   CheckProblemType
+	FileId uint32
+	Offset int64
+	Size   int64  // 损坏的字节数，到下一条完好的数据或文件末尾为止
+	SeqNo  uint64 // 事务序列号，只有 ProblemOrphanedTxn 才有
+	Err    error  // ProblemUnreadable 的具体原因
+}
+
+func (p *CheckProblem) String() string {
+	s := fmt.Sprintf("%09d%s @%d: %s (%d bytes)", p.FileId, data.DataFileNameSuffix, p.Offset, p.Type, p.Size)
+	if p.Type == ProblemOrphanedTxn {
+		s += fmt.Sprintf(" seq %d", p.SeqNo)
+	}
+	if p.Err != nil {
+		s += ": " + p.Err.Error()
+	}
+	return s
+}
+
+// FileCheckStat 单个数据文件的统计
+type FileCheckStat struct {
+	FileId        uint32
+	Size          int64
+	Records       int   // 完好的数据条数，包括删除标识与事务完成标识
+	Deleted       int   // 删除标识
+	TxnRecords    int   // 带事务序列号的数据，不含事务完成标识
+	Corrupted     int   // 读不出来的数据条数，不含没有完成标识的事务数据
+	CorruptedSize int64 // 读不出来的数据占用的字节数
+}
+
+// CheckReport 数据目录的检查结果
+type CheckReport struct {
+	Files    []*FileCheckStat
+	Problems []*CheckProblem
+}
+
+// OK 没有发现任何问题
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Check 离线检查 options.DirPath 中的每一个数据文件，数据库不能处于打开状态
+// 数据经过加密时 options 中的密钥要与打开数据库时相同
+func Check(options Options) (*CheckReport, error) {
+	c, err := newChecker(options)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	if err := c.run(); err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+// Repair 检查数据目录，并把所有还能读出来的有效数据写到 destDir 中，同时生成 hint 索引
+// destDir 不存在或为空，原目录不做任何修改
+// 写入时和打开数据库一样，按 options 中的压缩算法与 EncryptionKey 重新编码
+func Repair(options Options, destDir string) (*CheckReport, error) {
+	if err := os.MkdirAll(destDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		return nil, ErrRepairDirNotEmpty
+	}
+
+	c, err := newChecker(options)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	if err := c.run(); err != nil {
+		return nil, err
+	}
+	if err := c.copyTo(options, destDir); err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+// pendingTxnRecord 还没读到事务完成标识的数据
+type pendingTxnRecord struct {
+	key  []byte
+	typ  data.LogRecordType
+	pos  *data.LogRecordPos
+	size int64
+}
+
+type checker struct {
+	fileLock *flock.Flock
+	files    []*data.DataFile
+	report   *CheckReport
+
+	// 和启动时加载索引一样重放所有数据，修复时只复制最终有效的数据
+	index      map[string]*data.LogRecordPos
+	pendingTxn map[uint64][]*pendingTxnRecord
+}
+
+func newChecker(options Options) (*checker, error) {
+	dir := options.DirPath
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	codec, err := data.NewCodec(options.Compression, options.EncryptionKey, options.PreviousEncryptionKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	fileLock := flock.New(filepath.Join(dir, fileLockName))
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+
+	c := &checker{
+		fileLock:   fileLock,
+		report:     &CheckReport{},
+		index:      make(map[string]*data.LogRecordPos),
+		pendingTxn: make(map[uint64][]*pendingTxnRecord),
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	var fileIds []int
+	for _, entry := range dirEntries {
+		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			fileId, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+			if err != nil {
+				continue
+			}
+			fileIds = append(fileIds, fileId)
+		}
+	}
+	sort.Ints(fileIds)
+	for _, fid := range fileIds {
+		dataFile, err := data.OpenDataFile(dir, uint32(fid), fio.StandardFile)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		dataFile.Codec = codec
+		c.files = append(c.files, dataFile)
+	}
+	return c, nil
+}
+
+func (c *checker) close() {
+	for _, dataFile := range c.files {
+		_ = dataFile.Close()
+	}
+	_ = c.fileLock.Unlock()
+}
+
+func (c *checker) run() error {
+	for _, dataFile := range c.files {
+		if err := c.checkFile(dataFile); err != nil {
+			return err
+		}
+	}
+
+	// 剩下的事务数据都没有完成标识，启动时会被丢弃
+	var seqNos []uint64
+	for seqNo := range c.pendingTxn {
+		seqNos = append(seqNos, seqNo)
+	}
+	sort.Slice(seqNos, func(i, j int) bool { return seqNos[i] < seqNos[j] })
+	for _, seqNo := range seqNos {
+		for _, record := range c.pendingTxn[seqNo] {
+			c.report.Problems = append(c.report.Problems, &CheckProblem{
+				Type:   ProblemOrphanedTxn,
+				FileId: record.pos.Fid,
+				Offset: record.pos.Offset,
+				Size:   record.size,
+				SeqNo:  seqNo,
+			})
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkFile(dataFile *data.DataFile) error {
+	fileSize, err := dataFile.IOManager.Size()
+	if err != nil {
+		return err
+	}
+	stat := &FileCheckStat{FileId: dataFile.FileId, Size: fileSize}
+	c.report.Files = append(c.report.Files, stat)
+
+	var offset int64 = 0
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			problem := &CheckProblem{FileId: dataFile.FileId, Offset: offset, Size: size}
+			switch {
+			case err == io.ErrUnexpectedEOF || err == data.ErrInvalidCRC:
+				// 长度可能也损坏了，不能按它跳过，往后找到下一条完好的数据接着读
+				next, found, findErr := dataFile.NextLogRecordOffset(offset)
+				if findErr != nil {
+					return findErr
+				}
+				problem.Type = ProblemCRCMismatch
+				problem.Size = next - offset
+				if !found && err == io.ErrUnexpectedEOF {
+					problem.Type = ProblemTruncated
+				}
+			case size > 0:
+				problem.Type = ProblemUnreadable
+				problem.Err = err
+			default:
+				return err
+			}
+			c.report.Problems = append(c.report.Problems, problem)
+			stat.Corrupted++
+			stat.CorruptedSize += problem.Size
+			offset += problem.Size
+			continue
+		}
+
+		stat.Records++
+		pos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Expire: logRecord.Expire, Size: uint32(size)}
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		switch {
+		case logRecord.Type == data.LogRecordTxnFinished:
+			for _, record := range c.pendingTxn[seqNo] {
+				c.apply(record.key, record.typ, record.pos)
+			}
+			delete(c.pendingTxn, seqNo)
+		case seqNo == nonTransactionSeqNo:
+			if logRecord.Type == data.LogRecordDeleted {
+				stat.Deleted++
+			}
+			c.apply(realKey, logRecord.Type, pos)
+		default:
+			if logRecord.Type == data.LogRecordDeleted {
+				stat.Deleted++
+			}
+			stat.TxnRecords++
+			c.pendingTxn[seqNo] = append(c.pendingTxn[seqNo], &pendingTxnRecord{
+				key:  realKey,
+				typ:  logRecord.Type,
+				pos:  pos,
+				size: size,
+			})
+		}
+		offset += size
+	}
+	return nil
+}
+
+func (c *checker) apply(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	if typ == data.LogRecordDeleted || isExpired(pos.Expire) {
+		delete(c.index, string(key))
+		return
+	}
+	c.index[string(key)] = pos
+}
+
+// copyTo 按照 merge 的格式把有效数据写到 destDir，并生成 hint 索引与 merge 完成标识
+func (c *checker) copyTo(options Options, destDir string) error {
+	opts := options
+	opts.DirPath = destDir
+	opts.MMapStartup = false
+	opts.ReadOnly = false
+	opts.InMemory = false
+	opts.MergeCheckInterval = 0
+	// B+树索引文件一旦存在，启动时就不会加载 hint 索引，修复出来的目录只能用 hint 重建
+	opts.IndexType = Btree
+	opts.PreviousEncryptionKeys = nil
+	destDB, err := Open(opts)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	hintFile, err := data.OpenHintFile(destDir)
+	if err != nil {
+		return err
+	}
+	defer hintFile.Close()
+	hintFile.Codec = destDB.codec
+
+	files := make(map[uint32]*data.DataFile, len(c.files))
+	for _, dataFile := range c.files {
+		files[dataFile.FileId] = dataFile
+	}
+	realKeys := make([]string, 0, len(c.index))
+	for key := range c.index {
+		realKeys = append(realKeys, key)
+	}
+	sort.Strings(realKeys)
+
+	for _, key := range realKeys {
+		pos := c.index[key]
+		logRecord, _, err := files[pos.Fid].ReadLogRecord(pos.Offset)
+		if err != nil {
+			return err
+		}
+		logRecord.Key = logRecordKeyWithSeq([]byte(key), nonTransactionSeqNo)
+		newPos, err := destDB.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		if err := hintFile.WriteHintRecord([]byte(key), newPos); err != nil {
+			return err
+		}
+	}
+	if err := hintFile.Sync(); err != nil {
+		return err
+	}
+
+	// 封存写过的文件，之后的写入落在新的活跃文件上，不会被 hint 索引覆盖
+	if destDB.activeFile == nil {
+		if err := destDB.setActiveFile(); err != nil {
+			return err
+		}
+	}
+	nonMergeFileId := destDB.activeFile.FileId + 1
+	if err := destDB.rotateActiveFile(); err != nil {
+		return err
+	}
+	return writeMergeFinishedFile(destDir, nonMergeFileId)
+}
@@ -0,0 +1,195 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-check")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+
+	// 数据库开着的时候不能检查
+	_, err = Check(opts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	report, err := Check(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 1, len(report.Files))
+	assert.Equal(t, 100, report.Files[0].Records)
+
+	// 第 10 条数据损坏，末尾有一条没有完成标识的事务数据和一条写了一半的数据
+	_, recordSize := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(10), nonTransactionSeqNo),
+		Value: utils.RandomValue(24),
+	})
+	fileName := data.GetDataFileName(dir, 0)
+	corruptFile(t, fileName, 11*recordSize-1)
+	txnRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(200), 5),
+		Value: utils.RandomValue(24),
+	})
+	appendToFile(t, fileName, txnRecord)
+	appendToFile(t, fileName, txnRecord[:8])
+
+	report, err = Check(opts)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 100, report.Files[0].Records)
+	assert.Equal(t, 1, report.Files[0].TxnRecords)
+	assert.Equal(t, 2, report.Files[0].Corrupted)
+	assert.Equal(t, 3, len(report.Problems))
+	assert.Equal(t, ProblemCRCMismatch, report.Problems[0].Type)
+	assert.Equal(t, 10*recordSize, report.Problems[0].Offset)
+	assert.Equal(t, ProblemTruncated, report.Problems[1].Type)
+	assert.Equal(t, int64(8), report.Problems[1].Size)
+	assert.Equal(t, ProblemOrphanedTxn, report.Problems[2].Type)
+	assert.Equal(t, uint64(5), report.Problems[2].SeqNo)
+
+	// 修复到新目录，只保留有效数据
+	repairDir, _ := os.MkdirTemp("", "bitcask-go-repair")
+	defer os.RemoveAll(repairDir)
+	_, err = Repair(opts, dir)
+	assert.Equal(t, ErrRepairDirNotEmpty, err)
+	_, err = Repair(opts, repairDir)
+	assert.Nil(t, err)
+
+	repairOpts := opts
+	repairOpts.DirPath = repairDir
+	report, err = Check(repairOpts)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	db2, err := Open(repairOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 99, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db2.Get(utils.GetTestKey(200))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 修复后的目录可以正常写入
+	err = db2.Put(utils.GetTestKey(10), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+	db2, err = Open(repairOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db2.ListKeys()))
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestCheck_CorruptedHeader(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-check-header")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 第 10 条数据的 keySize 损坏，从下一条完好的数据接着检查，原文件不做修改
+	_, recordSize := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(10), nonTransactionSeqNo),
+		Value: utils.RandomValue(24),
+	})
+	fileName := data.GetDataFileName(dir, 0)
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0x7e}, 10*recordSize+5)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	report, err := Check(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 99, report.Files[0].Records)
+	assert.Equal(t, 1, len(report.Problems))
+	assert.Equal(t, ProblemCRCMismatch, report.Problems[0].Type)
+	assert.Equal(t, 10*recordSize, report.Problems[0].Offset)
+	assert.Equal(t, recordSize, report.Problems[0].Size)
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, 100*recordSize, info.Size())
+}
+
+func TestRepair_Options(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-repair-options")
+	opts.DirPath = dir
+	opts.Compression = GzipCompression
+	opts.EncryptionKey = []byte("0123456789abcdef")
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("bitcask-go"), 100)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), value)
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 没有密钥时读不出来
+	plainOpts := DefaultDBOptions
+	plainOpts.DirPath = dir
+	report, err := Check(plainOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(report.Problems))
+	assert.Equal(t, ProblemUnreadable, report.Problems[0].Type)
+
+	report, err = Check(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+
+	// 修复出来的数据按原来的配置压缩、加密
+	repairDir, _ := os.MkdirTemp("", "bitcask-go-repair-options-dest")
+	defer os.RemoveAll(repairDir)
+	_, err = Repair(opts, repairDir)
+	assert.Nil(t, err)
+
+	repairOpts := opts
+	repairOpts.DirPath = repairDir
+	report, err = Check(repairOpts)
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	plainOpts.DirPath = repairDir
+	report, err = Check(plainOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(report.Problems))
+	info, err := os.Stat(data.GetDataFileName(repairDir, 0))
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(100*len(value)))
+
+	db2, err := Open(repairOpts)
+	assert.Nil(t, err)
+	val, err := db2.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	assert.Nil(t, db2.Close())
+}
@@ -0,0 +1,77 @@
+// bitcask-redis 兼容 redis 协议（RESP）的服务端，可以直接用 redis-cli 或各语言的 redis 客户端访问
+//
+//	bitcask-redis -dir <数据目录> [-addr 127.0.0.1:6380] [-index btree|art|bptree]
+//
+// 支持的命令：PING GET SET DEL EXISTS KEYS SCAN MSET QUIT
+package main
+
+import (
+	bitcask "bitcask"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6380", "监听地址")
+	dir := flag.String("dir", "", "数据目录")
+	indexType := flag.String("index", "btree", "索引类型：btree、art、bptree")
+	flag.Parse()
+
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := serve(*addr, *dir, *indexType); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func serve(addr, dir, indexType string) error {
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath = dir
+	switch indexType {
+	case "btree":
+		opts.IndexType = bitcask.Btree
+	case "art":
+		opts.IndexType = bitcask.ART
+	case "bptree":
+		opts.IndexType = bitcask.BPlusTree
+	default:
+		return errors.New("不支持的索引类型：" + indexType)
+	}
+
+	db, err := bitcask.Open(opts)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	srv := newServer(db)
+	// 收到退出信号后先断开所有连接，再关闭数据库
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		_ = srv.close()
+	}()
+
+	fmt.Println("bitcask-redis 正在监听", listener.Addr())
+	serveErr := srv.serve(listener)
+	_ = srv.close()
+	if err := db.Close(); serveErr == nil {
+		serveErr = err
+	}
+	return serveErr
+}
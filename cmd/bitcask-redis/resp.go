@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RESP 协议的读写，只实现服务端需要的部分：
+// 读取客户端发来的命令（bulk string 数组或是 inline 命令），写回各类响应
+
+var errProtocol = errors.New("Protocol error")
+
+// 和 redis 一样限制一条命令的参数个数与单个参数的长度，避免按客户端发来的长度分配过多内存
+const (
+	maxMultiBulkLen = 1024 * 1024
+	maxBulkLen      = 512 * 1024 * 1024
+)
+
+type respReader struct {
+	r *bufio.Reader
+}
+
+func newRespReader(r io.Reader) *respReader {
+	return &respReader{r: bufio.NewReader(r)}
+}
+
+// ReadCommand 读取一条命令，返回命令名与参数
+func (rr *respReader) ReadCommand() ([][]byte, error) {
+	line, err := rr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	// inline 命令，比如 telnet 中直接敲的 "GET name"
+	if line[0] != '*' {
+		var args [][]byte
+		for _, field := range strings.Fields(string(line)) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxMultiBulkLen {
+		return nil, errProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		arg, err := rr.readBulkString()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// Buffered 缓冲区里还有没处理完的数据，说明客户端用了 pipeline
+func (rr *respReader) Buffered() int {
+	return rr.r.Buffered()
+}
+
+func (rr *respReader) readBulkString() ([]byte, error) {
+	line, err := rr.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return nil, errProtocol
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxBulkLen {
+		return nil, errProtocol
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return nil, err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, errProtocol
+	}
+	return buf[:n], nil
+}
+
+// readLine 读取一行，去掉结尾的 \r\n
+func (rr *respReader) readLine() ([]byte, error) {
+	line, err := rr.r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+type respWriter struct {
+	w *bufio.Writer
+}
+
+func newRespWriter(w io.Writer) *respWriter {
+	return &respWriter{w: bufio.NewWriter(w)}
+}
+
+func (rw *respWriter) WriteSimpleString(s string) {
+	rw.w.WriteString("+" + s + "\r\n")
+}
+
+func (rw *respWriter) WriteError(s string) {
+	rw.w.WriteString("-" + s + "\r\n")
+}
+
+func (rw *respWriter) WriteInteger(n int) {
+	rw.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (rw *respWriter) WriteBulkString(b []byte) {
+	rw.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	rw.w.Write(b)
+	rw.w.WriteString("\r\n")
+}
+
+// WriteNull 空回复，比如 GET 一个不存在的 key
+func (rw *respWriter) WriteNull() {
+	rw.w.WriteString("$-1\r\n")
+}
+
+// WriteArrayHeader 数组头，之后需要写入 n 个元素
+func (rw *respWriter) WriteArrayHeader(n int) {
+	rw.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (rw *respWriter) Flush() error {
+	return rw.w.Flush()
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	bitcask "bitcask"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// server 每个客户端连接一个 goroutine，并发安全由 DB 自己保证
+type server struct {
+	db *bitcask.DB
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func newServer(db *bitcask.DB) *server {
+	return &server{
+		db:    db,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// serve 在 listener 上接收连接，直到 close 被调用
+func (s *server) serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handleConn(conn)
+	}
+}
+
+// close 停止接收新连接，断开现有连接，并等待所有连接处理结束
+func (s *server) close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *server) handleConn(conn net.Conn) {
+	defer func() {
+		// 一个连接出了问题只断开这个连接，不影响整个服务
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "连接 %s 处理出错：%v\n", conn.RemoteAddr(), r)
+		}
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+		s.wg.Done()
+	}()
+
+	reader := newRespReader(conn)
+	writer := newRespWriter(conn)
+	for {
+		args, err := reader.ReadCommand()
+		if err != nil {
+			if err == errProtocol {
+				writer.WriteError("ERR " + err.Error())
+				_ = writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := s.execute(args, writer)
+		// pipeline 中的命令都处理完再一起返回
+		if quit || reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+type commandFunc func(s *server, args [][]byte, w *respWriter) error
+
+// 命令名 -> 处理函数与参数个数（包括命令名本身，负数表示至少需要的个数）
+var commandTable = map[string]struct {
+	fn    commandFunc
+	arity int
+}{
+	"ping":   {cmdPing, -1},
+	"get":    {cmdGet, 2},
+	"set":    {cmdSet, -3},
+	"del":    {cmdDel, -2},
+	"exists": {cmdExists, -2},
+	"keys":   {cmdKeys, 2},
+	"scan":   {cmdScan, -2},
+	"mset":   {cmdMSet, -3},
+}
+
+var errSyntax = errors.New("ERR syntax error")
+
+// execute 执行一条命令，返回值表示客户端是否要求断开连接
+func (s *server) execute(args [][]byte, w *respWriter) bool {
+	name := strings.ToLower(string(args[0]))
+	if name == "quit" {
+		w.WriteSimpleString("OK")
+		return true
+	}
+
+	cmd, ok := commandTable[name]
+	if !ok {
+		w.WriteError("ERR unknown command '" + string(args[0]) + "'")
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.WriteError("ERR wrong number of arguments for '" + name + "' command")
+		return false
+	}
+	if err := cmd.fn(s, args[1:], w); err != nil {
+		msg := err.Error()
+		if !strings.HasPrefix(msg, "ERR ") {
+			msg = "ERR " + msg
+		}
+		w.WriteError(msg)
+	}
+	return false
+}
+
+func cmdPing(_ *server, args [][]byte, w *respWriter) error {
+	if len(args) == 0 {
+		w.WriteSimpleString("PONG")
+		return nil
+	}
+	w.WriteBulkString(args[0])
+	return nil
+}
+
+func cmdGet(s *server, args [][]byte, w *respWriter) error {
+	value, err := s.db.Get(args[0])
+	if err == bitcask.ErrKeyNotFound {
+		w.WriteNull()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteBulkString(value)
+	return nil
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func cmdSet(s *server, args [][]byte, w *respWriter) error {
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil || n <= 0 {
+			return errors.New("ERR invalid expire time in 'set' command")
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "ex":
+			ttl = time.Duration(n) * time.Second
+		case "px":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			return errSyntax
+		}
+		i++
+	}
+
+	if err := s.db.PutWithTTL(args[0], args[1], ttl); err != nil {
+		return err
+	}
+	w.WriteSimpleString("OK")
+	return nil
+}
+
+func cmdDel(s *server, args [][]byte, w *respWriter) error {
+	var deleted int
+	for _, key := range args {
+		ok, err := s.db.Remove(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	w.WriteInteger(deleted)
+	return nil
+}
+
+func cmdExists(s *server, args [][]byte, w *respWriter) error {
+	var exists int
+	for _, key := range args {
+		if s.db.Exists(key) {
+			exists++
+		}
+	}
+	w.WriteInteger(exists)
+	return nil
+}
+
+func cmdKeys(s *server, args [][]byte, w *respWriter) error {
+	keys := s.matchKeys(args[0])
+	w.WriteArrayHeader(len(keys))
+	for _, key := range keys {
+		w.WriteBulkString(key)
+	}
+	return nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+// 游标是下一个要遍历的 key 的十六进制编码，用 Seek 直接定位，遍历结束时返回 0
+func cmdScan(s *server, args [][]byte, w *respWriter) error {
+	var start []byte
+	if string(args[0]) != "0" {
+		var err error
+		start, err = hex.DecodeString(string(args[0]))
+		if err != nil || len(start) == 0 {
+			return errors.New("ERR invalid cursor")
+		}
+	}
+	var pattern = []byte("*")
+	var count = 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errSyntax
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			var err error
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	iterOpts := bitcask.DefaultIteratorOptions
+	iterOpts.Prefix = patternPrefix(pattern)
+	iterOpts.KeysOnly = true
+	iter := s.db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	var keys [][]byte
+	if start == nil {
+		iter.Rewind()
+	} else {
+		iter.Seek(start)
+	}
+	for scanned := 0; iter.Valid() && scanned < count; iter.Next() {
+		scanned++
+		if matchPattern(pattern, iter.Key()) {
+			keys = append(keys, iter.Key())
+		}
+	}
+	var next = []byte("0")
+	if iter.Valid() {
+		next = []byte(hex.EncodeToString(iter.Key()))
+	}
+
+	w.WriteArrayHeader(2)
+	w.WriteBulkString(next)
+	w.WriteArrayHeader(len(keys))
+	for _, key := range keys {
+		w.WriteBulkString(key)
+	}
+	return nil
+}
+
+// MSET key value [key value ...]，通过 WriteBatch 原子写入
+func cmdMSet(s *server, args [][]byte, w *respWriter) error {
+	if len(args)%2 != 0 {
+		return errors.New("ERR wrong number of arguments for 'mset' command")
+	}
+	if !s.db.WriteBatchAvailable() {
+		return errors.New("ERR mset is unavailable: seq-no file is missing in B+tree index mode")
+	}
+	opts := bitcask.DefaultWriteBatchOptions
+	if uint(len(args)/2) > opts.MaxBatchNum {
+		opts.MaxBatchNum = uint(len(args) / 2)
+	}
+	wb := s.db.NewWriteBatch(opts)
+	for i := 0; i < len(args); i += 2 {
+		if err := wb.Put(args[i], args[i+1]); err != nil {
+			return err
+		}
+	}
+	if err := wb.Commit(); err != nil {
+		return err
+	}
+	w.WriteSimpleString("OK")
+	return nil
+}
+
+// matchKeys 返回匹配 pattern 的 key
+func (s *server) matchKeys(pattern []byte) [][]byte {
+	iterOpts := bitcask.DefaultIteratorOptions
+	iterOpts.Prefix = patternPrefix(pattern)
+	iter := s.db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if matchPattern(pattern, iter.Key()) {
+			keys = append(keys, iter.Key())
+		}
+	}
+	return keys
+}
+
+// patternPrefix pattern 中第一个通配符之前的部分，作为前缀来缩小遍历范围
+func patternPrefix(pattern []byte) []byte {
+	if i := strings.IndexAny(string(pattern), "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// matchPattern 与 redis 相同的 glob 匹配，支持 * ? [abc] [^a-z] 以及 \ 转义
+func matchPattern(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchPattern(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			var match bool
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) > 1 {
+					pattern = pattern[1:]
+					if pattern[0] == key[0] {
+						match = true
+					}
+				} else if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if key[0] >= lo && key[0] <= hi {
+						match = true
+					}
+					pattern = pattern[2:]
+				} else if pattern[0] == key[0] {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 || match == not {
+				return false
+			}
+			key = key[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			key = key[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(key) == 0
+}
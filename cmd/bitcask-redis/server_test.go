@@ -0,0 +1,298 @@
+package main
+
+import (
+	bitcask "bitcask"
+	"bitcask/data"
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 启动一个监听在本地随机端口的服务
+func startServer(t *testing.T) (string, func()) {
+	opts := bitcask.DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis")
+	opts.DirPath = dir
+	return startServerWithOptions(t, opts)
+}
+
+// startServerWithOptions 用指定的配置打开数据库并启动服务，停止时删除数据目录
+func startServerWithOptions(t *testing.T, opts bitcask.Options) (string, func()) {
+	dir := opts.DirPath
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	srv := newServer(db)
+	done := make(chan error)
+	go func() {
+		done <- srv.serve(listener)
+	}()
+
+	return listener.Addr().String(), func() {
+		assert.Nil(t, srv.close())
+		assert.Nil(t, <-done)
+		assert.Nil(t, db.Close())
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// 最简单的 RESP 客户端，发送命令并读取一个完整的响应
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	return &client{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) do(t *testing.T, args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.conn.Write([]byte(b.String()))
+	assert.Nil(t, err)
+	return c.readReply(t)
+}
+
+func (c *client) readReply(t *testing.T) string {
+	line, err := c.r.ReadString('\n')
+	assert.Nil(t, err)
+	switch line[0] {
+	case '$':
+		var n int
+		fmt.Sscanf(line, "$%d", &n)
+		if n < 0 {
+			return line
+		}
+		buf := make([]byte, n+2)
+		_, err := c.r.Read(buf)
+		assert.Nil(t, err)
+		return line + string(buf)
+	case '*':
+		var n int
+		fmt.Sscanf(line, "*%d", &n)
+		for i := 0; i < n; i++ {
+			line += c.readReply(t)
+		}
+	}
+	return line
+}
+
+func TestServer_Commands(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+	c := dial(t, addr)
+	defer c.conn.Close()
+
+	assert.Equal(t, "+PONG\r\n", c.do(t, "PING"))
+	assert.Equal(t, "+OK\r\n", c.do(t, "SET", "name", "bitcask-go"))
+	assert.Equal(t, "$10\r\nbitcask-go\r\n", c.do(t, "GET", "name"))
+	assert.Equal(t, "$-1\r\n", c.do(t, "GET", "unknown"))
+
+	assert.Equal(t, "+OK\r\n", c.do(t, "MSET", "k1", "v1", "k2", "v2", "k3", "v3"))
+	assert.Equal(t, ":2\r\n", c.do(t, "EXISTS", "k1", "k2", "k4"))
+	assert.Equal(t, "*3\r\n$2\r\nk1\r\n$2\r\nk2\r\n$2\r\nk3\r\n", c.do(t, "KEYS", "k*"))
+	assert.Equal(t, "*1\r\n$2\r\nk2\r\n", c.do(t, "KEYS", "k[^13]"))
+
+	// SCAN 分两次遍历完 k1 k2 k3，游标是下一个 key 的十六进制编码
+	assert.Equal(t, "*2\r\n$4\r\n6b33\r\n*2\r\n$2\r\nk1\r\n$2\r\nk2\r\n", c.do(t, "SCAN", "0", "MATCH", "k*", "COUNT", "2"))
+	assert.Equal(t, "*2\r\n$1\r\n0\r\n*1\r\n$2\r\nk3\r\n", c.do(t, "SCAN", "6b33", "MATCH", "k*", "COUNT", "2"))
+	// 游标对应的 key 不存在（比如被删掉了）时，从它之后的 key 继续
+	assert.Equal(t, "*2\r\n$8\r\n6e616d65\r\n*2\r\n$2\r\nk2\r\n$2\r\nk3\r\n", c.do(t, "SCAN", "6b31ff", "COUNT", "2"))
+	assert.Equal(t, "-ERR invalid cursor\r\n", c.do(t, "SCAN", "zz"))
+
+	assert.Equal(t, ":2\r\n", c.do(t, "DEL", "k1", "k2", "k4"))
+	assert.Equal(t, "$-1\r\n", c.do(t, "GET", "k1"))
+
+	// 带过期时间，过期之后 EXISTS、DEL 都当作不存在
+	assert.Equal(t, "+OK\r\n", c.do(t, "SET", "tmp", "1", "PX", "20"))
+	assert.Equal(t, ":1\r\n", c.do(t, "EXISTS", "tmp"))
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, "$-1\r\n", c.do(t, "GET", "tmp"))
+	assert.Equal(t, ":0\r\n", c.do(t, "EXISTS", "tmp"))
+	assert.Equal(t, ":0\r\n", c.do(t, "DEL", "tmp"))
+
+	// 出错的情况
+	assert.Equal(t, "-ERR unknown command 'HELLO'\r\n", c.do(t, "HELLO"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command\r\n", c.do(t, "GET"))
+	assert.Equal(t, "-ERR syntax error\r\n", c.do(t, "SET", "a", "b", "XX", "1"))
+	assert.Equal(t, "-ERR wrong number of arguments for 'mset' command\r\n", c.do(t, "MSET", "a", "b", "c"))
+
+	// inline 命令与 pipeline
+	_, err := c.conn.Write([]byte("SET a 1\r\nGET a\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "+OK\r\n", c.readReply(t))
+	assert.Equal(t, "$1\r\n1\r\n", c.readReply(t))
+
+	assert.Equal(t, "+OK\r\n", c.do(t, "QUIT"))
+}
+
+func TestServer_ConcurrentClients(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := dial(t, addr)
+			defer c.conn.Close()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("client-%d-key-%d", i, j)
+				assert.Equal(t, "+OK\r\n", c.do(t, "SET", key, key))
+				assert.Equal(t, fmt.Sprintf("$%d\r\n%s\r\n", len(key), key), c.do(t, "GET", key))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c := dial(t, addr)
+	defer c.conn.Close()
+	reply := c.do(t, "KEYS", "client-*")
+	assert.True(t, strings.HasPrefix(reply, "*1600\r\n"))
+}
+
+func TestServer_ConcurrentDel(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	c := dial(t, addr)
+	defer c.conn.Close()
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "+OK\r\n", c.do(t, "SET", fmt.Sprintf("key-%d", i), "value"))
+	}
+
+	// 同一个 key 只会被一个客户端删掉
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var deleted int
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := dial(t, addr)
+			defer c.conn.Close()
+			for j := 0; j < 100; j++ {
+				var n int
+				_, err := fmt.Sscanf(c.do(t, "DEL", fmt.Sprintf("key-%d", j)), ":%d", &n)
+				assert.Nil(t, err)
+				mu.Lock()
+				deleted += n
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 100, deleted)
+}
+
+func TestServer_MSetWithoutSeqNo(t *testing.T) {
+	opts := bitcask.DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-bptree")
+	opts.DirPath = dir
+	opts.IndexType = bitcask.BPlusTree
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("name"), []byte("bitcask-go")))
+	assert.Nil(t, db.Close())
+	// 模拟上次没有正常关闭
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.SeqNoFileName)))
+
+	addr, stop := startServerWithOptions(t, opts)
+	defer stop()
+	c := dial(t, addr)
+	defer c.conn.Close()
+
+	assert.True(t, strings.HasPrefix(c.do(t, "MSET", "k1", "v1"), "-ERR mset is unavailable"))
+	assert.Equal(t, "$-1\r\n", c.do(t, "GET", "k1"))
+	assert.Equal(t, "+OK\r\n", c.do(t, "SET", "k1", "v1"))
+	assert.Equal(t, "$10\r\nbitcask-go\r\n", c.do(t, "GET", "name"))
+}
+
+func TestServer_ProtocolLimits(t *testing.T) {
+	addr, stop := startServer(t)
+	defer stop()
+
+	// 超过上限的参数个数与参数长度直接报错断开，不会按这个长度分配内存
+	for _, request := range []string{
+		"*9223372036854775807\r\n",
+		"*1048577\r\n",
+		"*1\r\n$536870913\r\n",
+		"*1\r\n$9223372036854775807\r\n",
+	} {
+		c := dial(t, addr)
+		_, err := c.conn.Write([]byte(request))
+		assert.Nil(t, err)
+		assert.Equal(t, "-ERR Protocol error\r\n", c.readReply(t))
+		_, err = c.r.ReadByte()
+		assert.NotNil(t, err)
+		c.conn.Close()
+	}
+
+	c := dial(t, addr)
+	defer c.conn.Close()
+	assert.Equal(t, "+PONG\r\n", c.do(t, "PING"))
+}
+
+func TestServer_RecoverPanic(t *testing.T) {
+	commandTable["panic"] = struct {
+		fn    commandFunc
+		arity int
+	}{func(*server, [][]byte, *respWriter) error { panic("oops") }, 1}
+	defer delete(commandTable, "panic")
+
+	addr, stop := startServer(t)
+	defer stop()
+
+	// 出错的连接被断开，服务还在
+	c := dial(t, addr)
+	_, err := c.conn.Write([]byte("*1\r\n$5\r\npanic\r\n"))
+	assert.Nil(t, err)
+	_, err = c.r.ReadByte()
+	assert.NotNil(t, err)
+	c.conn.Close()
+
+	c = dial(t, addr)
+	defer c.conn.Close()
+	assert.Equal(t, "+PONG\r\n", c.do(t, "PING"))
+}
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchPattern([]byte(c.pattern), []byte(c.key)), c.pattern+" "+c.key)
+	}
+}
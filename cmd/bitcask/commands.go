@@ -0,0 +1,235 @@
+package main
+
+import (
+	bitcask "bitcask"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var errUsage = errors.New("参数错误")
+
+type command struct {
+	usage string // 参数说明
+	desc  string // 命令说明
+	run   func(db *bitcask.DB, args []string, out io.Writer) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"get":   {usage: "get <key>", desc: "读取 key 对应的 value", run: cmdGet},
+		"put":   {usage: "put <key> <value>", desc: "写入一条数据", run: cmdPut},
+		"del":   {usage: "del <key>", desc: "删除一条数据", run: cmdDel},
+		"scan":  {usage: "scan [--prefix <前缀>] [--reverse]", desc: "按顺序列出 key 与 value", run: cmdScan},
+		"keys":  {usage: "keys", desc: "列出所有 key", run: cmdKeys},
+		"stat":  {usage: "stat", desc: "查看统计信息", run: cmdStat},
+		"merge": {usage: "merge", desc: "清理无效数据，重新打开数据库后生效", run: cmdMerge},
+		"help":  {usage: "help", desc: "查看所有命令", run: cmdHelp},
+	}
+}
+
+// run 执行一条命令，args[0] 为命令名
+func run(db *bitcask.DB, args []string, out io.Writer) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("未知命令：%s，输入 help 查看所有命令", args[0])
+	}
+	if err := cmd.run(db, args[1:], out); err != nil {
+		if err == errUsage {
+			return fmt.Errorf("用法：%s", cmd.usage)
+		}
+		return err
+	}
+	return nil
+}
+
+// repl 交互模式，一行一条命令，出错时只打印错误，不退出
+func repl(db *bitcask.DB, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "bitcask> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		args, err := splitArgs(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(out, "(error)", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		if err := run(db, args, out); err != nil {
+			fmt.Fprintln(out, "(error)", err)
+		}
+	}
+}
+
+// splitArgs 按空白切分一行命令，和 shell 一样用引号包含空白：
+// 单引号中的内容原样保留，双引号中可以用反斜杠转义引号与反斜杠
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("引号没有闭合")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func printCommands(out io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out, "命令：")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-36s %s\n", commands[name].usage, commands[name].desc)
+	}
+}
+
+func cmdGet(db *bitcask.DB, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	value, err := db.Get([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, string(value))
+	return nil
+}
+
+func cmdPut(db *bitcask.DB, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	if err := db.Put([]byte(args[0]), []byte(args[1])); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "OK")
+	return nil
+}
+
+func cmdDel(db *bitcask.DB, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if err := db.Delete([]byte(args[0])); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "OK")
+	return nil
+}
+
+func cmdScan(db *bitcask.DB, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	prefix := fs.String("prefix", "", "只列出带有此前缀的 key")
+	reverse := fs.Bool("reverse", false, "倒序遍历")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	iterOpts := bitcask.DefaultIteratorOptions
+	iterOpts.Prefix = []byte(*prefix)
+	iterOpts.Reverse = *reverse
+	iter := db.NewIterator(iterOpts)
+	defer iter.Close()
+
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		value, err := iter.Value()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%s\t%s\n", iter.Key(), value)
+	}
+	return nil
+}
+
+func cmdKeys(db *bitcask.DB, args []string, out io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	for _, key := range db.ListKeys() {
+		fmt.Fprintln(out, string(key))
+	}
+	return nil
+}
+
+func cmdStat(db *bitcask.DB, args []string, out io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	stat, err := db.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "key 数量：\t%d\n", stat.KeyNum)
+	fmt.Fprintf(out, "数据文件数：\t%d\n", stat.DataFileNum)
+	fmt.Fprintf(out, "磁盘占用：\t%d\n", stat.DiskSize)
+	fmt.Fprintf(out, "可回收：\t%d\n", stat.ReclaimableSize)
+	if tail := stat.TruncatedTail; tail != nil {
+		fmt.Fprintf(out, "启动时截断：\t文件 %d 偏移 %d 处丢弃 %d 字节\n", tail.FileId, tail.Offset, tail.Size)
+	}
+	return nil
+}
+
+func cmdMerge(db *bitcask.DB, args []string, out io.Writer) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if err := db.Merge(); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "OK，重新打开数据库后生效")
+	return nil
+}
+
+func cmdHelp(_ *bitcask.DB, _ []string, out io.Writer) error {
+	printCommands(out)
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	bitcask "bitcask"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cli")
+	defer os.RemoveAll(dir)
+	db, err := openDB(dir, "btree", true)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	var out bytes.Buffer
+	err = run(db, []string{"put", "name", "bitcask-go"}, &out)
+	assert.Nil(t, err)
+	err = run(db, []string{"put", "age", "1"}, &out)
+	assert.Nil(t, err)
+	err = run(db, []string{"put", "nation", "cn"}, &out)
+	assert.Nil(t, err)
+
+	out.Reset()
+	err = run(db, []string{"get", "name"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "bitcask-go\n", out.String())
+
+	out.Reset()
+	err = run(db, []string{"scan", "--prefix", "na"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "name\tbitcask-go\nnation\tcn\n", out.String())
+
+	err = run(db, []string{"del", "name"}, &out)
+	assert.Nil(t, err)
+	err = run(db, []string{"get", "name"}, &out)
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	out.Reset()
+	err = run(db, []string{"keys"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "age\nnation\n", out.String())
+
+	out.Reset()
+	err = run(db, []string{"stat"}, &out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "key 数量：\t2")
+
+	// 参数错误与未知命令
+	err = run(db, []string{"get"}, &out)
+	assert.NotNil(t, err)
+	err = run(db, []string{"unknown"}, &out)
+	assert.NotNil(t, err)
+
+	// 数据目录不存在
+	_, err = openDB(dir+"-unknown", "btree", true)
+	assert.NotNil(t, err)
+}
+
+func TestRepl(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cli-repl")
+	defer os.RemoveAll(dir)
+	db, err := openDB(dir, "art", false)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	in := strings.NewReader("put a 1\n\nget a\nget b\nexit\nget a\n")
+	var out bytes.Buffer
+	err = repl(db, in, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "bitcask> OK\nbitcask> bitcask> 1\nbitcask> (error) 找不着key\nbitcask> ", out.String())
+
+	// value 中带空白时用引号括起来
+	in = strings.NewReader("put b \"hello world\"\nget b\nget \"b\n")
+	out.Reset()
+	err = repl(db, in, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "bitcask> OK\nbitcask> hello world\nbitcask> (error) 引号没有闭合\nbitcask> \n", out.String())
+}
+
+func TestSplitArgs(t *testing.T) {
+	for line, expected := range map[string][]string{
+		`put k "hello world"`:      {"put", "k", "hello world"},
+		`  get   k  `:              {"get", "k"},
+		`put 'a b' 'it"s'`:         {"put", "a b", `it"s`},
+		`put k "say \"hi\" \\ ok"`: {"put", "k", `say "hi" \ ok`},
+		`put k ""`:                 {"put", "k", ""},
+		`put k a"b c"d`:            {"put", "k", "ab cd"},
+		``:                         nil,
+	} {
+		args, err := splitArgs(line)
+		assert.Nil(t, err, line)
+		assert.Equal(t, expected, args, line)
+	}
+
+	_, err := splitArgs(`put k "hello`)
+	assert.NotNil(t, err)
+}
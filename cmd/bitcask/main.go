@@ -0,0 +1,91 @@
+// bitcask 命令行工具，用来查看、修改数据目录中的数据
+//
+//	bitcask -dir <数据目录> [-index btree|art|bptree] [-mmap=true] <命令> [参数...]
+//
+// fsck 等离线命令不打开数据库，直接读取数据文件
+//
+// 不带命令时进入交互模式，输入 help 查看所有命令
+package main
+
+import (
+	bitcask "bitcask"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	dir := flag.String("dir", "", "数据目录")
+	indexType := flag.String("index", "btree", "索引类型：btree、art、bptree")
+	mmap := flag.Bool("mmap", true, "启动时是否使用内存文件映射加载数据文件")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 0 && offlineCommands[flag.Arg(0)] != nil {
+		if err := runOffline(*dir, flag.Args(), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *dir == "" {
+		usage()
+		os.Exit(2)
+	}
+
+	db, err := openDB(*dir, *indexType, *mmap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if flag.NArg() == 0 {
+		err = repl(db, os.Stdin, os.Stdout)
+	} else {
+		err = run(db, flag.Args(), os.Stdout)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "用法：bitcask -dir <数据目录> [选项] [命令] [参数...]")
+	fmt.Fprintln(out, "不带命令时进入交互模式")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "选项：")
+	flag.PrintDefaults()
+	fmt.Fprintln(out)
+	printCommands(out)
+	fmt.Fprintln(out)
+	printOfflineCommands(out)
+}
+
+// openDB 打开已有的数据目录，避免写错路径时新建出一个空数据库
+func openDB(dir, indexType string, mmap bool) (*bitcask.DB, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath = dir
+	opts.MMapStartup = mmap
+	switch indexType {
+	case "btree":
+		opts.IndexType = bitcask.Btree
+	case "art":
+		opts.IndexType = bitcask.ART
+	case "bptree":
+		opts.IndexType = bitcask.BPlusTree
+	default:
+		return nil, errors.New("不支持的索引类型：" + indexType)
+	}
+	return bitcask.Open(opts)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	bitcask "bitcask"
+	"bitcask/data"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// previewSize dump 时 key 与 value 最多显示的字节数
+const previewSize = 48
+
+// offlineCommand 离线命令直接读取数据文件，不打开数据库
+type offlineCommand struct {
+	usage string
+	desc  string
+	run   func(dir string, args []string, out io.Writer) error
+}
+
+var offlineCommands map[string]*offlineCommand
+
+func init() {
+	offlineCommands = map[string]*offlineCommand{
+		"fsck": {usage: "fsck [--key <hex>] [--compression <算法>] [--repair <目录>]", desc: "检查数据文件，--repair 把有效数据写到新目录", run: cmdFsck},
+		"dump": {usage: "dump [--json] [--key <hex>] <文件>", desc: "逐条打印数据文件、hint 等文件中的记录", run: cmdDump},
+	}
+}
+
+// runOffline 执行一条离线命令，args[0] 为命令名
+func runOffline(dir string, args []string, out io.Writer) error {
+	cmd := offlineCommands[args[0]]
+	if err := cmd.run(dir, args[1:], out); err != nil {
+		if err == errUsage {
+			return fmt.Errorf("用法：%s", cmd.usage)
+		}
+		return err
+	}
+	return nil
+}
+
+func printOfflineCommands(out io.Writer) {
+	names := make([]string, 0, len(offlineCommands))
+	for name := range offlineCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out, "离线命令（数据库不能处于打开状态）：")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-36s %s\n", offlineCommands[name].usage, offlineCommands[name].desc)
+	}
+}
+
+func cmdFsck(dir string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	repairDir := fs.String("repair", "", "把有效数据写到这个目录")
+	key := fs.String("key", "", "数据经过加密时的密钥，十六进制")
+	var previousKeys [][]byte
+	fs.Func("previous-key", "轮换之前的旧密钥，十六进制，可以有多个", func(s string) error {
+		previousKey, err := hex.DecodeString(s)
+		previousKeys = append(previousKeys, previousKey)
+		return err
+	})
+	compression := fs.String("compression", "none", "修复时写入所用的压缩算法：none、flate、gzip")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || dir == "" {
+		return errUsage
+	}
+
+	// 与打开数据库时的配置相同，修复时按它重新压缩、加密
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath = dir
+	opts.PreviousEncryptionKeys = previousKeys
+	var err error
+	if opts.EncryptionKey, err = hex.DecodeString(*key); err != nil {
+		return errUsage
+	}
+	switch *compression {
+	case "none":
+		opts.Compression = bitcask.NoCompression
+	case "flate":
+		opts.Compression = bitcask.FlateCompression
+	case "gzip":
+		opts.Compression = bitcask.GzipCompression
+	default:
+		return errUsage
+	}
+
+	var report *bitcask.CheckReport
+	if *repairDir != "" {
+		report, err = bitcask.Repair(opts, *repairDir)
+	} else {
+		report, err = bitcask.Check(opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "文件\t大小\t数据\t删除\t事务\t损坏")
+	for _, file := range report.Files {
+		fmt.Fprintf(w, "%09d.data\t%d\t%d\t%d\t%d\t%d\n",
+			file.FileId, file.Size, file.Records, file.Deleted, file.TxnRecords, file.Corrupted)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Fprintln(out, problem)
+	}
+	if *repairDir != "" {
+		fmt.Fprintf(out, "有效数据已写入 %s\n", *repairDir)
+		return nil
+	}
+	if !report.OK() {
+		return fmt.Errorf("发现 %d 处问题", len(report.Problems))
+	}
+	fmt.Fprintln(out, "OK")
+	return nil
+}
+
+// dumpRecord dump --json 时每一行的内容
+type dumpRecord struct {
+	Offset    int64              `json:"offset"`
+	Size      int64              `json:"size"`
+	Type      string             `json:"type,omitempty"`
+	SeqNo     uint64             `json:"seq,omitempty"`
+	Expire    string             `json:"expire,omitempty"`
+	Key       string             `json:"key,omitempty"`
+	Value     string             `json:"value,omitempty"`
+	ValueSize int                `json:"value_size"`
+	Pos       *data.LogRecordPos `json:"pos,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+func cmdDump(_ string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	jsonOutput := fs.Bool("json", false, "每条记录输出一行 JSON")
+	key := fs.String("key", "", "数据经过加密时的密钥，十六进制")
+	var previousKeys [][]byte
+	fs.Func("previous-key", "轮换之前的旧密钥，十六进制，可以有多个", func(s string) error {
+		previousKey, err := hex.DecodeString(s)
+		previousKeys = append(previousKeys, previousKey)
+		return err
+	})
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	encryptionKey, err := hex.DecodeString(*key)
+	if err != nil {
+		return errUsage
+	}
+	// 只用来读取，压缩算法按每条记录自身的标志解压
+	codec, err := data.NewCodec(data.NoCompression, encryptionKey, previousKeys...)
+	if err != nil {
+		return err
+	}
+
+	scanner, err := data.NewRecordScanner(fs.Arg(0), codec)
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+
+	encoder := json.NewEncoder(out)
+	for scanner.Scan() {
+		record := newDumpRecord(scanner.FileType(), scanner.Record())
+		if *jsonOutput {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+			continue
+		}
+
+		line := fmt.Sprintf("@%d size=%d", record.Offset, record.Size)
+		if record.Error != "" {
+			fmt.Fprintf(out, "%s error=%s\n", line, record.Error)
+			continue
+		}
+		line += " type=" + record.Type
+		if t := scanner.FileType(); t == data.DataFileType || t == data.FileHintType {
+			line += fmt.Sprintf(" seq=%d", record.SeqNo)
+		}
+		if record.Expire != "" {
+			line += " expire=" + record.Expire
+		}
+		line += fmt.Sprintf(" key=%q", record.Key)
+		if record.Pos != nil {
+			line += fmt.Sprintf(" pos=%d:%d size=%d", record.Pos.Fid, record.Pos.Offset, record.Pos.Size)
+		} else {
+			line += fmt.Sprintf(" value=%q value_size=%d", record.Value, record.ValueSize)
+		}
+		fmt.Fprintln(out, line)
+	}
+	return scanner.Err()
+}
+
+func newDumpRecord(fileType data.FileType, record *data.ScannedRecord) *dumpRecord {
+	r := &dumpRecord{Offset: record.Offset, Size: record.Size}
+	if record.Err != nil {
+		r.Error = record.Err.Error()
+		return r
+	}
+
+	switch fileType {
+	case data.DataFileType, data.FileHintType:
+		r.Type = recordTypeName(record.Type)
+		r.SeqNo = record.SeqNo
+	default:
+		r.Type = fileType.String()
+	}
+	if record.Expire > 0 {
+		r.Expire = time.Unix(0, record.Expire).Format(time.RFC3339)
+	}
+	r.Key = preview(record.Key)
+	r.Value = preview(record.Value)
+	r.ValueSize = len(record.Value)
+	r.Pos = record.Pos
+	return r
+}
+
+func recordTypeName(t data.LogRecordType) string {
+	switch t {
+	case data.LogRecordNormal:
+		return "normal"
+	case data.LogRecordDeleted:
+		return "deleted"
+	case data.LogRecordTxnFinished:
+		return "txn-finished"
+	}
+	return strconv.Itoa(int(t))
+}
+
+// preview 截取开头的一部分，不是合法 UTF-8 的内容显示为十六进制
+func preview(b []byte) string {
+	valid := utf8.Valid(b)
+	var suffix string
+	if len(b) > previewSize {
+		b, suffix = b[:previewSize], "..."
+		// 不要把一个字符截成两半
+		for valid && !utf8.Valid(b) {
+			b = b[:len(b)-1]
+		}
+	}
+	if !valid {
+		return fmt.Sprintf("0x%x", b) + suffix
+	}
+	return string(b) + suffix
+}
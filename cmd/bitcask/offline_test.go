@@ -0,0 +1,167 @@
+package main
+
+import (
+	bitcask "bitcask"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cli-fsck")
+	defer os.RemoveAll(dir)
+	db, err := openDB(dir, "btree", true)
+	assert.Nil(t, err)
+	var out bytes.Buffer
+	err = run(db, []string{"put", "name", "bitcask-go"}, &out)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	out.Reset()
+	err = runOffline(dir, []string{"fsck"}, &out)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(out.String(), "OK\n"))
+	assert.Contains(t, out.String(), "000000000.data")
+
+	// 末尾写了一半的数据
+	f, err := os.OpenFile(filepath.Join(dir, "000000000.data"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{1, 2, 3, 4, 5, 6})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	out.Reset()
+	err = runOffline(dir, []string{"fsck"}, &out)
+	assert.NotNil(t, err)
+	assert.Contains(t, out.String(), "truncated")
+
+	repairDir := filepath.Join(dir, "repair")
+	out.Reset()
+	err = runOffline(dir, []string{"fsck", "--repair", repairDir}, &out)
+	assert.Nil(t, err)
+	db, err = openDB(repairDir, "btree", true)
+	assert.Nil(t, err)
+	defer db.Close()
+	out.Reset()
+	err = run(db, []string{"get", "name"}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "bitcask-go\n", out.String())
+
+	err = runOffline(dir, []string{"fsck", "extra"}, &out)
+	assert.NotNil(t, err)
+}
+
+func TestFsck_Key(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cli-fsck-key")
+	defer os.RemoveAll(dir)
+	key := []byte("0123456789abcdef")
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath = dir
+	opts.EncryptionKey = key
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	err = db.Put([]byte("name"), []byte("bitcask-go"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 加密的数据没有密钥读不出来
+	var out bytes.Buffer
+	err = runOffline(dir, []string{"fsck"}, &out)
+	assert.NotNil(t, err)
+	assert.Contains(t, out.String(), "unreadable")
+
+	out.Reset()
+	err = runOffline(dir, []string{"fsck", "--key", hex.EncodeToString(key)}, &out)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(out.String(), "OK\n"))
+
+	err = runOffline(dir, []string{"fsck", "--key", "xyz"}, &out)
+	assert.NotNil(t, err)
+}
+
+func TestDump(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cli-dump")
+	defer os.RemoveAll(dir)
+	db, err := openDB(dir, "btree", true)
+	assert.Nil(t, err)
+	var out bytes.Buffer
+	err = run(db, []string{"put", "name", "bitcask-go"}, &out)
+	assert.Nil(t, err)
+	err = run(db, []string{"del", "name"}, &out)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	out.Reset()
+	err = runOffline("", []string{"dump", filepath.Join(dir, "000000000.data")}, &out)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], `type=normal seq=0 key="name" value="bitcask-go"`)
+	assert.Contains(t, lines[1], `type=deleted`)
+
+	out.Reset()
+	err = runOffline("", []string{"dump", "--json", filepath.Join(dir, "seq-no")}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"offset":0,"size":14,"type":"seq-no","key":"seq.no","value":"0","value_size":1}`+"\n"+
+		`{"offset":14,"size":21,"type":"seq-no","key":"reclaim.size","value":"34","value_size":2}`+"\n", out.String())
+
+	err = runOffline("", []string{"dump"}, &out)
+	assert.NotNil(t, err)
+}
+
+func TestDump_Key(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cli-dump-key")
+	defer os.RemoveAll(dir)
+	oldKey := []byte("fedcba9876543210")
+	key := []byte("0123456789abcdef")
+	opts := bitcask.DefaultDBOptions
+	opts.DirPath = dir
+	opts.EncryptionKey = oldKey
+	db, err := bitcask.Open(opts)
+	assert.Nil(t, err)
+	err = db.Put([]byte("name"), []byte("bitcask-go"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 轮换密钥之后再写一条
+	opts.EncryptionKey = key
+	opts.PreviousEncryptionKeys = [][]byte{oldKey}
+	db, err = bitcask.Open(opts)
+	assert.Nil(t, err)
+	err = db.Put([]byte("lang"), []byte("go"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	dataFile := filepath.Join(dir, "000000000.data")
+
+	// 没有密钥时每条都读不出来
+	var out bytes.Buffer
+	err = runOffline("", []string{"dump", dataFile}, &out)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	for _, line := range lines {
+		assert.Contains(t, line, "error=")
+	}
+
+	out.Reset()
+	err = runOffline("", []string{"dump", "--key", hex.EncodeToString(key),
+		"--previous-key", hex.EncodeToString(oldKey), dataFile}, &out)
+	assert.Nil(t, err)
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Contains(t, lines[0], `key="name" value="bitcask-go"`)
+	assert.Contains(t, lines[1], `key="lang" value="go"`)
+
+	err = runOffline("", []string{"dump", "--key", "xyz", dataFile}, &out)
+	assert.NotNil(t, err)
+}
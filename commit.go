@@ -0,0 +1,197 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"sync/atomic"
+)
+
+// commitRequest 一次写入（Put、Delete 或者 WriteBatch.Commit）
+type commitRequest struct {
+	logRecords []*data.LogRecord
+	sync       bool
+	// 写入之前在 db.mu 下调用，返回错误时这次写入不会进行，用于乐观事务的冲突检测
+	check func() error
+	// 数据写入并持久化之后调用，按写入顺序更新索引
+	apply func(positions []*data.LogRecordPos) error
+
+	err  error
+	lead bool // 被唤醒时由它接着处理队列中剩下的写入
+	done chan struct{}
+}
+
+// commit 写入一组数据，返回时数据已经按 sync 的要求持久化，索引也已经更新
+//
+// 并发的写入在队列中排队，由队首的 leader 把当前排着的所有写入合成一次写入、一次持久化，
+// 完成后唤醒它们，再把 leader 交给排在后面的第一个写入
+func (db *DB) commit(logRecords []*data.LogRecord, sync bool, apply func([]*data.LogRecordPos) error) error {
+	return db.commitWithCheck(logRecords, sync, nil, apply)
+}
+
+// commitWithCheck 同 commit，写入之前先调用 check，check 与前面排着的写入是串行的
+func (db *DB) commitWithCheck(logRecords []*data.LogRecord, sync bool, check func() error,
+	apply func([]*data.LogRecordPos) error) error {
+	req := &commitRequest{
+		logRecords: logRecords,
+		sync:       sync,
+		check:      check,
+		apply:      apply,
+		done:       make(chan struct{}),
+	}
+
+	db.commitMu.Lock()
+	if db.committing {
+		db.commitQueue = append(db.commitQueue, req)
+		db.commitMu.Unlock()
+		<-req.done
+		if !req.lead {
+			return req.err
+		}
+		db.commitMu.Lock()
+	}
+	db.committing = true
+	group := append([]*commitRequest{req}, db.commitQueue...)
+	db.commitQueue = nil
+	db.commitMu.Unlock()
+
+	db.commitGroup(group)
+
+	// 交出 leader，没有排队的写入就结束
+	db.commitMu.Lock()
+	if len(db.commitQueue) > 0 {
+		next := db.commitQueue[0]
+		db.commitQueue = db.commitQueue[1:]
+		next.lead = true
+		close(next.done)
+	} else {
+		db.committing = false
+	}
+	db.commitMu.Unlock()
+
+	for _, r := range group[1:] {
+		close(r.done)
+	}
+	return req.err
+}
+
+// commitGroup 一次写入整组数据，只要有一个写入需要持久化就持久化一次
+func (db *DB) commitGroup(group []*commitRequest) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var logRecords []*data.LogRecord
+	var sync bool
+	var accepted []*commitRequest
+	for _, req := range group {
+		// 按顺序检查，前面的写入已经计入了冲突检测
+		if req.check != nil {
+			if err := req.check(); err != nil {
+				req.err = err
+				continue
+			}
+		}
+		db.trackTxnWrites(req.logRecords)
+		accepted = append(accepted, req)
+		logRecords = append(logRecords, req.logRecords...)
+		sync = sync || req.sync
+	}
+	if len(accepted) == 0 {
+		return
+	}
+
+	var err error
+	if db.activeFile == nil {
+		err = db.setActiveFile()
+	}
+	// 写到一半换了活跃文件时，前一个文件已经封存，没法回滚
+	// 多个写入一起可能写不下时，整组作为一个事务写入，失败时没有完成标识，重启后不会生效
+	var groupTxnFin bool
+	if err == nil && len(accepted) > 1 && !db.fitsActiveFile(logRecords) {
+		logRecords = groupTxnLogRecords(logRecords, atomic.AddUint64(&db.seqNo, 1))
+		groupTxnFin = true
+	}
+	var positions []*data.LogRecordPos
+	// 记下写入前活跃文件的位置，失败时回滚
+	rollbackFile := db.activeFile
+	var rollbackOffset int64
+	var rollbackHints int
+	var rollbackCRC uint32
+	if err == nil {
+		rollbackOffset, rollbackHints, rollbackCRC = db.activeFile.WOffset, len(db.activeHints), db.activeCRC
+		positions, err = db.writeLogRecords(logRecords)
+	}
+	if err == nil {
+		err = db.syncIfNeeded(sync)
+	}
+	if err != nil {
+		// 调用方拿到的是错误，已经写进去的数据也不能在重启之后出现
+		// 写入途中换了活跃文件就没法回滚了，此时写入的都是事务数据，没有完成标识，重启时会被丢掉
+		if rollbackFile != nil && rollbackFile == db.activeFile {
+			if truncErr := db.activeFile.Truncate(rollbackOffset); truncErr == nil && db.activeHintsComplete {
+				db.activeHints = db.activeHints[:rollbackHints]
+				db.activeCRC = rollbackCRC
+			}
+		} else if rollbackFile != nil {
+			// 留在文件里的数据重放时会算作可回收的空间，这里也要算上
+			atomic.AddInt64(&db.reclaimSize, db.writtenSince(rollbackFile, rollbackOffset))
+		}
+		for _, req := range accepted {
+			req.err = err
+		}
+		return
+	}
+
+	for _, req := range accepted {
+		n := len(req.logRecords)
+		req.err = req.apply(positions[:n])
+		positions = positions[n:]
+	}
+	// 剩下的是整组事务的完成标识
+	if groupTxnFin {
+		atomic.AddInt64(&db.reclaimSize, int64(positions[0].Size))
+	}
+}
+
+// writtenSince 从 dataFile 的 offset 处开始，到当前活跃文件末尾写入的字节数
+func (db *DB) writtenSince(dataFile *data.DataFile, offset int64) int64 {
+	size := dataFile.WOffset - offset
+	for fid := dataFile.FileId + 1; fid <= db.activeFile.FileId; fid++ {
+		if fid == db.activeFile.FileId {
+			size += db.activeFile.WOffset
+		} else if olderFile := db.olderFiles[fid]; olderFile != nil {
+			size += olderFile.WOffset
+		}
+	}
+	return size
+}
+
+// fitsActiveFile logRecords 能否全部写进当前的活跃文件，按编码后长度的上限估计
+func (db *DB) fitsActiveFile(logRecords []*data.LogRecord) bool {
+	size := db.activeFile.WOffset
+	for _, logRecord := range logRecords {
+		size += db.codec.MaxEncodedSize(logRecord)
+	}
+	return size <= db.options.DataFileSize
+}
+
+// groupTxnLogRecords 把一组写入的数据都换成序列号 seqNo，最后加上完成标识
+// 数据的条数与顺序不变；WriteBatch 原有的完成标识留着，它的序列号下已经没有数据，重放时不起作用
+func groupTxnLogRecords(logRecords []*data.LogRecord, seqNo uint64) []*data.LogRecord {
+	records := make([]*data.LogRecord, 0, len(logRecords)+1)
+	for _, logRecord := range logRecords {
+		if logRecord.Type == data.LogRecordTxnFinished {
+			records = append(records, logRecord)
+			continue
+		}
+		key, _ := parseLogRecordKey(logRecord.Key)
+		records = append(records, &data.LogRecord{
+			Key:    logRecordKeyWithSeq(key, seqNo),
+			Value:  logRecord.Value,
+			Type:   logRecord.Type,
+			Expire: logRecord.Expire,
+		})
+	}
+	return append(records, &data.LogRecord{
+		Key:  logRecordKeyWithSeq(txnFin, seqNo),
+		Type: data.LogRecordTxnFinished,
+	})
+}
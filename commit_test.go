@@ -0,0 +1,92 @@
+package bitcask_go
+
+import (
+	"bitcask/fio"
+	"bitcask/utils"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncCounter 统计活跃文件的持久化次数
+type syncCounter struct {
+	fio.IOManager
+	syncs int64
+}
+
+func (s *syncCounter) Sync() error {
+	atomic.AddInt64(&s.syncs, 1)
+	return s.IOManager.Sync()
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.SyncWrite = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(utils.GetTestKey(0), utils.RandomValue(24))
+	assert.Nil(t, err)
+	counter := &syncCounter{IOManager: db.activeFile.IOManager}
+	db.activeFile.IOManager = counter
+
+	// 第一个写入拿不到 db.mu，就像正在持久化一样，其余的写入都在排队
+	const writers = 20
+	db.mu.Lock()
+	var wg sync.WaitGroup
+	for i := 1; i <= writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%5 == 0 {
+				wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+				_ = wb.Put(utils.GetTestKey(i), []byte("batch"))
+				err = wb.Commit()
+			} else {
+				err = db.Put(utils.GetTestKey(i), []byte("put"))
+			}
+			assert.Nil(t, err)
+		}(i)
+	}
+	for {
+		db.commitMu.Lock()
+		queued := len(db.commitQueue)
+		db.commitMu.Unlock()
+		if queued == writers-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	db.mu.Unlock()
+	wg.Wait()
+
+	// 第一个写入单独一组，排队的写入合成一组
+	assert.Equal(t, int64(2), atomic.LoadInt64(&counter.syncs))
+	for i := 1; i <= writers; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i%5 == 0 {
+			assert.Equal(t, []byte("batch"), val)
+		} else {
+			assert.Equal(t, []byte("put"), val)
+		}
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	stat, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(writers+1), stat.KeyNum)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
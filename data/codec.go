@@ -0,0 +1,124 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+var (
+	ErrInvalidEncryptionKey = errors.New("密钥长度必须是 16、24 或 32 字节")
+	ErrMissingEncryptionKey = errors.New("数据已加密，但是没有配置密钥")
+	ErrDecryptFailed        = errors.New("解密失败，密钥错误或者数据已损坏")
+)
+
+// AES-GCM 的 nonce 与认证标签的长度
+const (
+	nonceSize       = 12
+	encryptOverhead = nonceSize + 16
+)
+
+// Codec 数据写入文件前对 value 的处理方式
+// 读取时根据 header 中的标志位还原，所以更换 Codec 之后，之前写入的数据依然可以读出
+type Codec struct {
+	Compression CompressionType // 写入时使用的压缩算法
+
+	encryptor  cipher.AEAD   // 写入时使用，为 nil 表示不加密
+	decryptors []cipher.AEAD // 读取时依次尝试，包括轮换前的旧密钥
+}
+
+// NewCodec key 为空表示写入时不加密，oldKeys 是轮换之前用过的密钥，只用于读取
+func NewCodec(compression CompressionType, key []byte, oldKeys ...[]byte) (*Codec, error) {
+	c := &Codec{Compression: compression}
+	if len(key) > 0 {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		c.encryptor = aead
+		c.decryptors = append(c.decryptors, aead)
+	}
+	for _, k := range oldKeys {
+		aead, err := newAEAD(k)
+		if err != nil {
+			return nil, err
+		}
+		c.decryptors = append(c.decryptors, aead)
+	}
+	return c, nil
+}
+
+// EncodeLogRecord 按照 Codec 编码 logRecord，codec 为 nil 时与 EncodeLogRecord 相同
+func (c *Codec) EncodeLogRecord(logRecord *LogRecord) ([]byte, int64, error) {
+	if c == nil {
+		enc, size := EncodeLogRecord(logRecord)
+		return enc, size, nil
+	}
+
+	value, compression, err := c.compress(logRecord.Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return encodeLogRecord(logRecord, value, compression, c.encryptor)
+}
+
+// MaxEncodedSize logRecord 编码之后长度的上限，不用真的编码就能估计写不写得下
+// 压缩之后变大时会原样写入，所以不会超过未压缩的长度
+func (c *Codec) MaxEncodedSize(logRecord *LogRecord) int64 {
+	size := int64(maxLogRecordHeaderSize + len(logRecord.Key) + len(logRecord.Value))
+	if c != nil && c.encryptor != nil {
+		size += encryptOverhead
+	}
+	return size
+}
+
+func (c *Codec) compress(value []byte) ([]byte, CompressionType, error) {
+	if c.Compression == NoCompression || len(value) == 0 {
+		return value, NoCompression, nil
+	}
+
+	compressor, ok := LookupCompressor(c.Compression)
+	if !ok {
+		return nil, NoCompression, ErrUnknownCompression
+	}
+	compressed, err := compressor.Compress(value)
+	if err != nil {
+		return nil, NoCompression, err
+	}
+	// 压缩之后反而变大了，那就原样写入
+	if len(compressed) >= len(value) {
+		return value, NoCompression, nil
+	}
+	return compressed, c.Compression, nil
+}
+
+// open 解密 | nonce | 密文 |，依次尝试每一个密钥
+func (c *Codec) open(sealed, additionalData []byte) ([]byte, error) {
+	if c == nil || len(c.decryptors) == 0 {
+		return nil, ErrMissingEncryptionKey
+	}
+	nonce, ciphertext := sealed[:nonceSize], sealed[nonceSize:]
+	for _, aead := range c.decryptors {
+		if plain, err := aead.Open(nil, nonce, ciphertext, additionalData); err == nil {
+			return plain, nil
+		}
+	}
+	return nil, ErrDecryptFailed
+}
+
+func seal(aead cipher.AEAD, plain, additionalData []byte) ([]byte, error) {
+	sealed := make([]byte, nonceSize, encryptOverhead+len(plain))
+	if _, err := rand.Read(sealed); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, sealed, plain, additionalData), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidEncryptionKey
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,114 @@
+package data
+
+import (
+	"bitcask/fio"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec_EncodeLogRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-codec")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFile)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	value := bytes.Repeat([]byte("bitcask-go"), 100)
+	plain, plainSize := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: value})
+	err = dataFile.Write(plain)
+	assert.Nil(t, err)
+
+	var offset = plainSize
+	for _, c := range []CompressionType{FlateCompression, GzipCompression} {
+		codec := &Codec{Compression: c}
+		enc, size, err := codec.EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: value, Expire: 100})
+		assert.Nil(t, err)
+		assert.Less(t, size, plainSize)
+		err = dataFile.Write(enc)
+		assert.Nil(t, err)
+
+		logRecord, readSize, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, size, readSize)
+		assert.Equal(t, value, logRecord.Value)
+		assert.Equal(t, int64(100), logRecord.Expire)
+		offset += size
+	}
+
+	// 没压缩的数据照样能读
+	logRecord, _, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, value, logRecord.Value)
+
+	// 压缩后没有变小的 value 原样写入
+	codec := &Codec{Compression: GzipCompression}
+	enc, _, err := codec.EncodeLogRecord(&LogRecord{Key: []byte("k"), Value: []byte("v")})
+	assert.Nil(t, err)
+	plain, _ = EncodeLogRecord(&LogRecord{Key: []byte("k"), Value: []byte("v")})
+	assert.Equal(t, plain, enc)
+
+	// 未注册的算法
+	codec = &Codec{Compression: 100}
+	_, _, err = codec.EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: value})
+	assert.Equal(t, ErrUnknownCompression, err)
+}
+
+func TestCodec_Encryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-codec")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFile)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	oldKey := bytes.Repeat([]byte("k"), 16)
+	newKey := bytes.Repeat([]byte("n"), 32)
+	oldCodec, err := NewCodec(GzipCompression, oldKey)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("bitcask-go"), 100)
+	log1 := &LogRecord{Key: []byte("name"), Value: value, Expire: 100}
+	enc, size, err := oldCodec.EncodeLogRecord(log1)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(enc, []byte("name")))
+	err = dataFile.Write(enc)
+	assert.Nil(t, err)
+
+	// 没有密钥读不出来
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Equal(t, ErrMissingEncryptionKey, err)
+
+	// 密钥不对
+	dataFile.Codec, err = NewCodec(NoCompression, newKey)
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Equal(t, ErrDecryptFailed, err)
+
+	// 轮换之后旧密钥写入的数据仍可读取
+	dataFile.Codec, err = NewCodec(NoCompression, newKey, oldKey)
+	assert.Nil(t, err)
+	logRecord, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, readSize)
+	assert.Equal(t, log1, logRecord)
+
+	// hint 同样加密
+	err = dataFile.WriteHintRecord([]byte("name"), &LogRecordPos{Fid: 1, Offset: 10})
+	assert.Nil(t, err)
+	logRecord, _, err = dataFile.ReadLogRecord(size)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("name"), logRecord.Key)
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 10}, DecodeLogRecordPos(logRecord.Value))
+
+	// 密文被篡改，crc 就通不过
+	enc[len(enc)-1]++
+	err = dataFile.Write(enc)
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLogRecord(dataFile.WOffset - size)
+	assert.Equal(t, ErrInvalidCRC, err)
+
+	_, err = NewCodec(NoCompression, []byte("short"))
+	assert.Equal(t, ErrInvalidEncryptionKey, err)
+}
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrUnknownCompression = errors.New("未知的压缩算法")
+
+// CompressionType 压缩算法的编号，会写入每条数据的 header 中
+type CompressionType = byte
+
+const (
+	NoCompression CompressionType = iota
+	FlateCompression
+	GzipCompression
+)
+
+// Compressor 压缩算法，标准库之外的实现可以通过 RegisterCompressor 接入
+type Compressor interface {
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	compressorsLock = new(sync.RWMutex)
+	compressors     = map[CompressionType]Compressor{
+		FlateCompression: flateCompressor{},
+		GzipCompression:  gzipCompressor{},
+	}
+)
+
+// RegisterCompressor 注册压缩算法
+// 编号写入数据文件之后就不能再换成别的算法，否则旧数据将无法解压
+func RegisterCompressor(t CompressionType, c Compressor) {
+	if t == NoCompression {
+		panic("0 号表示不压缩，不能注册")
+	}
+	compressorsLock.Lock()
+	compressors[t] = c
+	compressorsLock.Unlock()
+}
+
+// LookupCompressor 根据编号找到对应的压缩算法
+func LookupCompressor(t CompressionType) (Compressor, bool) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	c, ok := compressors[t]
+	return c, ok
+}
+
+func decompress(t CompressionType, src []byte) ([]byte, error) {
+	c, ok := LookupCompressor(t)
+	if !ok {
+		return nil, ErrUnknownCompression
+	}
+	return c.Decompress(src)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
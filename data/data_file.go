@@ -9,6 +9,10 @@ import (
 	"path/filepath"
 )
 
+var (
+	ErrInvalidCRC = errors.New("crc校验错误")
+)
+
 const (
 	DataFileNameSuffix    = ".data"
 	HintFileName          = "hint-index"
@@ -20,6 +24,7 @@ type DataFile struct {
 	FileId    uint32
 	WOffset   int64 // 从文件哪个地方开始写的偏移量
 	IOManager fio.IOManager
+	Codec     *Codec // 加密数据的读取与 hint 的写入需要用到，为 nil 时只能处理明文
 }
 
 // OpenDataFile 根据目录，打开对应目的文件。返回目的数据文件地址、错误
@@ -89,6 +94,10 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	header, headerSize := decodeLogRecordHeader(headerBuf)
 
 	if header == nil {
+		// 文件末尾只剩不到一个 header 的数据，说明写到一半就中断了
+		if headerBytes > 0 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
 		return nil, 0, io.EOF
 	}
 
@@ -96,24 +105,167 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		return nil, 0, io.EOF
 	}
 
+	// header 解不出来：读到的 header 不完整，是写到一半；否则是数据损坏，不能当成写到一半
+	if header.malformed {
+		if headerBytes < maxLogRecordHeaderSize {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return nil, 0, ErrInvalidCRC
+	}
+
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
-	var recordSize = headerSize + keySize + valueSize
+	var bodySize = keySize + valueSize
+	if header.encrypted {
+		bodySize += encryptOverhead
+	}
+	var recordSize = headerSize + bodySize
+
+	// 数据不完整
+	if offset+recordSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
 
-	var logRecord = &LogRecord{Type: header.recordType}
-	if keySize > 0 || valueSize > 0 {
-		kvBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
+	var kvBuf []byte
+	if bodySize > 0 {
+		kvBuf, err = df.readNBytes(bodySize, offset+headerSize)
 		if err != nil {
 			return nil, 0, err
 		}
+	}
+
+	// 校验失败时也返回这条数据的长度，方便调用方判断它是不是文件里的最后一条
+	logRecord, err := df.decodeLogRecord(header, headerBuf[:headerSize], kvBuf)
+	if err != nil {
+		return nil, recordSize, err
+	}
+	return logRecord, recordSize, nil
+}
+
+// checksumBufferSize 计算整个文件的 crc 时，每次读入的字节数
+const checksumBufferSize = 1024 * 1024
+
+// Checksum 文件前 size 个字节的 crc，用来确认封存的文件没有被改动过
+func (df *DataFile) Checksum(size int64) (uint32, error) {
+	var crc uint32
+	buf := make([]byte, min(size, checksumBufferSize))
+	for offset := int64(0); offset < size; {
+		n := min(int64(len(buf)), size-offset)
+		if _, err := df.IOManager.Read(buf[:n], offset); err != nil {
+			return 0, err
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, buf[:n])
+		offset += n
+	}
+	return crc, nil
+}
+
+// resyncWindow 查找下一条完好的数据时，每次读入的字节数
+const resyncWindow = 64 * 1024
+
+// NextLogRecordOffset offset 处的数据读不出来时，逐字节往后查找下一条完整且 crc 校验通过的数据
+// 找到时返回它的位置，找不到时返回文件大小与 false，说明 offset 之后没有任何完好的数据
+func (df *DataFile) NextLogRecordOffset(offset int64) (int64, bool, error) {
+	fileSize, err := df.IOManager.Size()
+	if err != nil {
+		return 0, false, err
+	}
+	for start := offset + 1; start < fileSize; start += resyncWindow {
+		buf, err := df.readNBytes(min(resyncWindow+maxLogRecordHeaderSize, fileSize-start), start)
+		if err != nil {
+			return 0, false, err
+		}
+		for i := 0; i < resyncWindow && i < len(buf); i++ {
+			ok, err := df.isLogRecordAt(buf[i:], start+int64(i), fileSize)
+			if err != nil {
+				return 0, false, err
+			}
+			if ok {
+				return start + int64(i), true, nil
+			}
+		}
+	}
+	return fileSize, false, nil
+}
+
+// isLogRecordAt offset 处是不是一条完整且 crc 校验通过的数据，buf 是从 offset 开始已经读出来的内容
+func (df *DataFile) isLogRecordAt(buf []byte, offset, fileSize int64) (bool, error) {
+	header, headerSize := decodeLogRecordHeader(buf[:min(len(buf), maxLogRecordHeaderSize)])
+	if header == nil || header.malformed || header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
+		return false, nil
+	}
+	var recordSize = headerSize + int64(header.keySize) + int64(header.valueSize)
+	if header.encrypted {
+		recordSize += encryptOverhead
+	}
+	if offset+recordSize > fileSize {
+		return false, nil
+	}
+
+	record := buf
+	if recordSize > int64(len(buf)) {
+		var err error
+		if record, err = df.readNBytes(recordSize, offset); err != nil {
+			return false, err
+		}
+	}
+	// crc 覆盖 header 中 crc 之后的部分以及紧跟着的 key/value
+	return crc32.ChecksumIEEE(record[crc32.Size:recordSize]) == header.crc, nil
+}
+
+// ReadLogRecordAt 已知数据编码后的长度（LogRecordPos.Size）时，一次读出整条数据
+// 不需要先读 header 再读 key/value，也不需要获取文件大小
+func (df *DataFile) ReadLogRecordAt(offset int64, size int64) (*LogRecord, error) {
+	buf, err := df.readNBytes(size, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	header, headerSize := decodeLogRecordHeader(buf)
+	if header == nil {
+		return nil, ErrInvalidCRC
+	}
+	var bodySize = int64(header.keySize) + int64(header.valueSize)
+	if header.encrypted {
+		bodySize += encryptOverhead
+	}
+	// 长度对不上，说明位置信息或者数据有误
+	if headerSize+bodySize != size {
+		return nil, ErrInvalidCRC
+	}
+	return df.decodeLogRecord(header, buf[:headerSize], buf[headerSize:])
+}
+
+// decodeLogRecord 校验 crc，并还原加密、压缩过的 key/value
+func (df *DataFile) decodeLogRecord(header *LogRecordHeader, headerBuf []byte, kvBuf []byte) (*LogRecord, error) {
+	keySize := int64(header.keySize)
+	var logRecord = &LogRecord{Type: header.recordType, Expire: header.expire}
+	if len(kvBuf) > 0 {
 		logRecord.Key = kvBuf[:keySize]
 		logRecord.Value = kvBuf[keySize:]
 	}
 
-	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
+	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:])
 	if crc != header.crc {
-		return nil, 0, errors.New("crc校验错误")
+		return nil, ErrInvalidCRC
 	}
-	return logRecord, recordSize, nil
+
+	// crc 是按加密、压缩后的内容算的，校验通过之后再解密、解压
+	if header.encrypted {
+		kvBuf, err := df.Codec.open(kvBuf, headerBuf[crc32.Size:])
+		if err != nil {
+			return nil, err
+		}
+		logRecord.Key = kvBuf[:keySize]
+		logRecord.Value = kvBuf[keySize:]
+	}
+	if header.compression != NoCompression {
+		value, err := decompress(header.compression, logRecord.Value)
+		if err != nil {
+			return nil, err
+		}
+		logRecord.Value = value
+	}
+	return logRecord, nil
 }
 
 func (df *DataFile) Write(b []byte) error {
@@ -121,6 +273,10 @@ func (df *DataFile) Write(b []byte) error {
 	// 写入后注意更新偏移量（WOffset）
 	n, err := df.IOManager.Write(b)
 	if err != nil {
+		// 只写进去一部分时截掉，否则之后的数据会接在半条数据后面，和 WOffset 对不上
+		if n > 0 {
+			_ = df.IOManager.Truncate(df.WOffset)
+		}
 		return err
 	}
 	df.WOffset += int64(n)
@@ -132,10 +288,22 @@ func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 		Key:   key,
 		Value: EncodeLogRecordPos(pos),
 	}
-	encRecord, _ := EncodeLogRecord(hintRecord)
+	encRecord, _, err := df.Codec.EncodeLogRecord(hintRecord)
+	if err != nil {
+		return err
+	}
 	return df.Write(encRecord)
 }
 
+// Truncate 把文件截断到 size，用于丢弃尾部损坏的数据
+func (df *DataFile) Truncate(size int64) error {
+	if err := df.IOManager.Truncate(size); err != nil {
+		return err
+	}
+	df.WOffset = size
+	return nil
+}
+
 func (df *DataFile) Sync() error {
 	return df.IOManager.Sync()
 }
@@ -2,6 +2,7 @@ package data
 
 import (
 	"bitcask/fio"
+	"io"
 	"os"
 	"testing"
 
@@ -100,3 +101,68 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, readSize3, size3)
 	t.Log(len(encLog3))
 }
+
+func TestDataFile_ReadLogRecord_Torn(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-torn")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFile)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+
+	log1 := &LogRecord{
+		Key:   []byte("name"),
+		Value: []byte("bitcask-go"),
+		Type:  LogRecordNormal,
+	}
+	encLog1, size1 := EncodeLogRecord(log1)
+	err = dataFile.Write(encLog1)
+	assert.Nil(t, err)
+
+	// 只写了一半
+	err = dataFile.Write(encLog1[:size1/2])
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLogRecord(size1)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// 截掉之后就读到文件末尾了
+	err = dataFile.Truncate(size1)
+	assert.Nil(t, err)
+	assert.Equal(t, size1, dataFile.WOffset)
+	_, _, err = dataFile.ReadLogRecord(size1)
+	assert.Equal(t, io.EOF, err)
+
+	// 长度完整但是内容有误
+	encLog1[size1-1]++
+	err = dataFile.Write(encLog1)
+	assert.Nil(t, err)
+	_, size, err := dataFile.ReadLogRecord(size1)
+	assert.Equal(t, ErrInvalidCRC, err)
+	assert.Equal(t, size1, size)
+}
+
+func TestDataFile_ReadLogRecordAt(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-at")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFile)
+	assert.Nil(t, err)
+
+	log1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go")}
+	encLog1, size1 := EncodeLogRecord(log1)
+	log2 := &LogRecord{Key: []byte("name"), Type: LogRecordDeleted}
+	encLog2, size2 := EncodeLogRecord(log2)
+	assert.Nil(t, dataFile.Write(encLog1))
+	assert.Nil(t, dataFile.Write(encLog2))
+
+	record, err := dataFile.ReadLogRecordAt(0, size1)
+	assert.Nil(t, err)
+	assert.Equal(t, log1.Value, record.Value)
+	record, err = dataFile.ReadLogRecordAt(size1, size2)
+	assert.Nil(t, err)
+	assert.Equal(t, LogRecordDeleted, record.Type)
+
+	// 长度与数据对不上
+	_, err = dataFile.ReadLogRecordAt(0, size1+size2)
+	assert.Equal(t, ErrInvalidCRC, err)
+	_, err = dataFile.ReadLogRecordAt(0, size1-1)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
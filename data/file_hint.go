@@ -0,0 +1,158 @@
+package data
+
+import (
+	"bitcask/fio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileHintNameSuffix 封存的数据文件对应的 hint 文件，<fileId>.hint
+// 与 merge 生成的 hint-index 不同，它按顺序记录了数据文件中的每一条数据（不含 value），
+// 启动时按同样的逻辑重放即可，不需要读取整个数据文件
+const FileHintNameSuffix = ".hint"
+
+// ErrHintMismatch hint 与数据文件对不上，数据文件在封存之后被改动或损坏了
+var ErrHintMismatch = errors.New("hint 与数据文件不一致")
+
+// fileHintChecksumKey <fileId>.hint 最后一条记录的 key，value 是数据文件封存时的大小与 crc
+// 数据文件中不会有序列号为 0 的事务完成标识，不会和其他记录混淆
+var fileHintChecksumKey = LogRecordKeyWithSeq([]byte("file.checksum"), 0)
+
+func isFileHintChecksum(logRecord *LogRecord) bool {
+	return logRecord.Type == LogRecordTxnFinished && bytes.Equal(logRecord.Key, fileHintChecksumKey)
+}
+
+// HintRecord 数据文件中一条数据在 hint 中的记录
+type HintRecord struct {
+	Key  []byte // 带有事务序列号的 key，与数据文件中一致
+	Type LogRecordType
+	Pos  *LogRecordPos
+}
+
+func GetFileHintName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+FileHintNameSuffix)
+}
+
+// WriteFileHint 为 fileId 对应的数据文件写入 hint，最后记下数据文件的大小与 crc
+// 先写临时文件再改名，所以 hint 文件要么完整，要么不存在
+func WriteFileHint(dirPath string, fileId uint32, records []*HintRecord, fileSize int64, fileCRC uint32, codec *Codec) error {
+	value := make([]byte, binary.MaxVarintLen64+4)
+	n := binary.PutVarint(value, fileSize)
+	binary.LittleEndian.PutUint32(value[n:], fileCRC)
+	checksum := &LogRecord{Key: fileHintChecksumKey, Value: value[:n+4], Type: LogRecordTxnFinished}
+	return writeHintRecords(GetFileHintName(dirPath, fileId), records, codec, checksum)
+}
+
+// RewriteHintFile 用 records 整体替换 merge 生成的 hint-index，records 中的 key 不带序列号
+func RewriteHintFile(dirPath string, records []*HintRecord, codec *Codec) error {
+	return writeHintRecords(filepath.Join(dirPath, HintFileName), records, codec)
+}
+
+// writeHintRecords 写入 records，extra 原样追加在后面
+func writeHintRecords(fileName string, records []*HintRecord, codec *Codec, extra ...*LogRecord) error {
+	var buf bytes.Buffer
+	for _, record := range records {
+		enc, _, err := codec.EncodeLogRecord(&LogRecord{
+			Key:   record.Key,
+			Value: EncodeLogRecordPos(record.Pos),
+			Type:  record.Type,
+		})
+		if err != nil {
+			return err
+		}
+		buf.Write(enc)
+	}
+	for _, logRecord := range extra {
+		enc, _, err := codec.EncodeLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		buf.Write(enc)
+	}
+
+	tmpFileName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+// ReadFileHint 读取数据文件对应的 hint，hint 不存在时返回 os.ErrNotExist
+// 数据文件的大小要和 hint 中记录的一致，verify 为 true 时还要核对整个数据文件的 crc，
+// 否则返回 ErrHintMismatch，此时只能读取数据文件本身
+func ReadFileHint(dirPath string, dataFile *DataFile, verify bool) ([]*HintRecord, error) {
+	fileName := GetFileHintName(dirPath, dataFile.FileId)
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+	hintFile, err := newDataFile(fileName, dataFile.FileId, fio.StandardFile)
+	if err != nil {
+		return nil, err
+	}
+	defer hintFile.Close()
+	hintFile.Codec = dataFile.Codec
+
+	var records []*HintRecord
+	var checksum []byte
+	var offset int64 = 0
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		offset += size
+		if isFileHintChecksum(logRecord) {
+			checksum = logRecord.Value
+			continue
+		}
+		records = append(records, &HintRecord{
+			Key:  logRecord.Key,
+			Type: logRecord.Type,
+			Pos:  DecodeLogRecordPos(logRecord.Value),
+		})
+	}
+
+	// 没有记录大小与 crc 的 hint 也不能用
+	fileSize, n := binary.Varint(checksum)
+	if n <= 0 || len(checksum) != n+4 {
+		return nil, ErrHintMismatch
+	}
+	size, err := dataFile.IOManager.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size != fileSize {
+		return nil, ErrHintMismatch
+	}
+	if !verify {
+		return records, nil
+	}
+	crc, err := dataFile.Checksum(fileSize)
+	if err != nil {
+		return nil, err
+	}
+	if crc != binary.LittleEndian.Uint32(checksum[n:]) {
+		return nil, ErrHintMismatch
+	}
+	return records, nil
+}
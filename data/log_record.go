@@ -1,21 +1,33 @@
 package data
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"hash/crc32"
+	"math"
 )
 
 // LogRecordPos 定义logRecord在哪个文件的哪个地方
 type LogRecordPos struct {
 	Fid    uint32 // 数据文件的文件id。文件名 int64 可能比较大，比较浪费 int32 比较合理
 	Offset int64  // 存储值在这一条目中的偏移位置
+	Expire int64  // 过期时间（UnixNano），0 表示永不过期
+	Size   uint32 // 这条数据编码后在磁盘上占用的大小，读取时一次 ReadAt 读完；旧版本索引中为 0，启动时补上
 }
 
 type LogRecordType = byte
 
-// header = crc + type + keySize + valueSize
+// header = crc + type + keySize + valueSize + expire + compression
 // ?
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 5 + 1
+
+// recordType 这一字节只用低四位存类型，高位留作标志位
+const (
+	logRecordTypeMask   byte = 0x0f
+	logRecordExpire     byte = 1 << 7 // header 中带有过期时间
+	logRecordCompressed byte = 1 << 6 // value 经过压缩，header 中带有压缩算法
+	logRecordEncrypted  byte = 1 << 5 // key 与 value 经过加密
+)
 
 const (
 	LogRecordNormal LogRecordType = iota
@@ -25,16 +37,21 @@ const (
 
 // LogRecord 写入到数据文件的记录
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType // 这条数据是删除还是存储？
+	Key    []byte
+	Value  []byte
+	Type   LogRecordType // 这条数据是删除还是存储？
+	Expire int64         // 过期时间（UnixNano），0 表示永不过期
 }
 
 type LogRecordHeader struct {
-	crc        uint32
-	recordType LogRecordType
-	keySize    uint32
-	valueSize  uint32
+	crc         uint32
+	recordType  LogRecordType
+	keySize     uint32
+	valueSize   uint32
+	expire      int64
+	compression CompressionType
+	encrypted   bool
+	malformed   bool // 类型或长度解不出来，不可能是正常写入的数据
 }
 
 type TransactionRecord struct {
@@ -44,10 +61,24 @@ type TransactionRecord struct {
 
 // EncodeLogRecord 返回编码后的数组与其长度
 //
-// |   crc   |  recordType  |  keySize  |  valueSize  |  key  |  value  |
+// |   crc   |  recordType  |  keySize  |  valueSize  |  expire  |  compression  |  key  |  value  |
+//
+//	4            1          max: 5     max: 5      max: 10         1          var      var
+//
+// expire 与 compression 只有在设置了过期时间、value 经过压缩时才会写入，
+// 并在 recordType 的高位打上标志，因此普通数据与旧格式完全一致
 //
-//	4            1          max: 5     max: 5        var      var
+// 加密时 key 与 value 整体加密，替换为 | nonce | 密文 |，
+// header 中的 keySize 与 valueSize 仍是加密前的长度
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+	// 不加密就不会出错
+	enc, size, _ := encodeLogRecord(logRecord, logRecord.Value, NoCompression, nil)
+	return enc, size
+}
+
+// encodeLogRecord value 是实际写入文件的内容，compression 是它所用的压缩算法，
+// aead 不为 nil 时对 key 与 value 加密
+func encodeLogRecord(logRecord *LogRecord, value []byte, compression CompressionType, aead cipher.AEAD) ([]byte, int64, error) {
 	// 先对头部信息（keySize&valueSize）二进制编码（recordType,key和value已经是二进制了） -> binary.PutVarint
 	// 作为校验选项，crc需要最后写入
 	// 二进制编码先recordType开始，到valueSize
@@ -56,33 +87,67 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	header := make([]byte, maxLogRecordHeaderSize)
 
 	header[4] = logRecord.Type
+	if logRecord.Expire > 0 {
+		header[4] |= logRecordExpire
+	}
+	if compression != NoCompression {
+		header[4] |= logRecordCompressed
+	}
+	if aead != nil {
+		header[4] |= logRecordEncrypted
+	}
 
 	// 5是keySize的位置
 	var index = 5
 
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	index += binary.PutVarint(header[index:], int64(len(value)))
+	if logRecord.Expire > 0 {
+		index += binary.PutVarint(header[index:], logRecord.Expire)
+	}
+	if compression != NoCompression {
+		header[index] = compression
+		index++
+	}
 
-	var size = index + len(logRecord.Key) + len(logRecord.Value)
+	var size = index + len(logRecord.Key) + len(value)
+	if aead != nil {
+		size += encryptOverhead
+	}
 
 	encodeBytes := make([]byte, size)
 
 	copy(encodeBytes[:index], header[:index])
-	copy(encodeBytes[index:], logRecord.Key)
-	copy(encodeBytes[index+len(logRecord.Key):], logRecord.Value)
+	if aead != nil {
+		body := make([]byte, 0, len(logRecord.Key)+len(value))
+		body = append(body, logRecord.Key...)
+		body = append(body, value...)
+		// header 作为附加数据一起认证，防止长度等信息被篡改
+		sealed, err := seal(aead, body, header[4:index])
+		if err != nil {
+			return nil, 0, err
+		}
+		copy(encodeBytes[index:], sealed)
+	} else {
+		copy(encodeBytes[index:], logRecord.Key)
+		copy(encodeBytes[index+len(logRecord.Key):], value)
+	}
 
 	crc := crc32.ChecksumIEEE(encodeBytes[4:])
 	binary.LittleEndian.PutUint32(encodeBytes[:4], crc)
 
-	return encodeBytes, int64(size)
+	return encodeBytes, int64(size), nil
 }
 
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	// LogRecordPos Fid uint32 offset int64
-	buf := make([]byte, binary.MaxVarintLen64+binary.MaxVarintLen32)
+	// LogRecordPos Fid uint32 offset int64 expire int64 size uint32
+	// 新字段只往后加，解码时缺少的字段为 0：最早只有 fid 和 offset，之后依次加上了 expire 和 size
+	buf := make([]byte, binary.MaxVarintLen64*2+binary.MaxVarintLen32*2)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
+	index += binary.PutVarint(buf[index:], pos.Expire)
+	index += binary.PutVarint(buf[index:], int64(pos.Size))
 	return buf[:index]
 }
 
@@ -90,10 +155,22 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	var index = 0
 	fileId, n := binary.Varint(buf[index:])
 	index += n
-	offset, _ := binary.Varint(buf[index:])
+	offset, n := binary.Varint(buf[index:])
+	index += n
+	// 旧版本编码中没有 expire 或者 size
+	var expire, size int64
+	if index < len(buf) {
+		expire, n = binary.Varint(buf[index:])
+		index += n
+	}
+	if index < len(buf) {
+		size, _ = binary.Varint(buf[index:])
+	}
 	return &LogRecordPos{
 		Fid:    uint32(fileId),
 		Offset: offset,
+		Expire: expire,
+		Size:   uint32(size),
 	}
 }
 
@@ -109,22 +186,62 @@ func decodeLogRecordHeader(headerbuf []byte) (*LogRecordHeader, int64) {
 
 	header := &LogRecordHeader{
 		crc:        binary.LittleEndian.Uint32(headerbuf[:4]),
-		recordType: headerbuf[4],
+		recordType: headerbuf[4] & logRecordTypeMask,
+		encrypted:  headerbuf[4]&logRecordEncrypted != 0,
 	}
 
 	var index = 5
 
 	keySize, n := binary.Varint(headerbuf[index:])
 	header.keySize = uint32(keySize)
-	index += n
+	header.malformed = n <= 0 || keySize < 0 || keySize > math.MaxUint32
+	index += max(n, 0)
 
 	valueSize, n := binary.Varint(headerbuf[index:])
 	header.valueSize = uint32(valueSize)
-	index += n
+	header.malformed = header.malformed || n <= 0 || valueSize < 0 || valueSize > math.MaxUint32
+	index += max(n, 0)
+
+	if header.recordType > LogRecordTxnFinished {
+		header.malformed = true
+	}
+
+	if headerbuf[4]&logRecordExpire != 0 {
+		expire, n := binary.Varint(headerbuf[index:])
+		header.expire = expire
+		header.malformed = header.malformed || n <= 0
+		index += max(n, 0)
+	}
+
+	if headerbuf[4]&logRecordCompressed != 0 && index < len(headerbuf) {
+		header.compression = headerbuf[index]
+		index++
+	}
 
 	return header, int64(index)
 }
 
+// LogRecordKeyWithSeq 数据文件中的 key 前面带有事务序列号，非事务数据的序列号为 0
+func LogRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
+	seq := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(seq[:], seqNo)
+
+	encKey := make([]byte, n+len(key))
+
+	copy(encKey[:n], seq[:n])
+	copy(encKey[n:], key)
+
+	return encKey
+}
+
+// ParseLogRecordKey 解析分离出key与seqNo
+func ParseLogRecordKey(key []byte) ([]byte, uint64) {
+	seqNo, n := binary.Uvarint(key)
+
+	realKey := key[n:]
+	return realKey, seqNo
+}
+
 // getLogRecordCRC 传入LogRecord和除crc之外的header部分，返回编码后的crc
 func getLogRecordCRC(l *LogRecord, h []byte) uint32 {
 	if l == nil {
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"encoding/binary"
 	"hash/crc32"
 	"testing"
 
@@ -73,3 +74,43 @@ func TestGetLogRecordCRC(t *testing.T) {
 	crc2 := getLogRecordCRC(log2, headerBuf2[crc32.Size:])
 	assert.Equal(t, crc2, uint32(240712713))
 }
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	log1 := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("enophan"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	enc1, n1 := EncodeLogRecord(log1)
+	assert.NotNil(t, enc1)
+
+	// 类型字节的高位标识带有过期时间，解码后类型不受影响
+	header1, size1 := decodeLogRecordHeader(enc1)
+	assert.Equal(t, LogRecordNormal, header1.recordType)
+	assert.Equal(t, log1.Expire, header1.expire)
+	assert.Equal(t, n1, size1+int64(len(log1.Key)+len(log1.Value)))
+
+	crc1 := getLogRecordCRC(log1, enc1[crc32.Size:size1])
+	assert.Equal(t, header1.crc, crc1)
+}
+
+func TestEncodeLogRecordPos(t *testing.T) {
+	pos1 := &LogRecordPos{Fid: 3, Offset: 1024, Expire: 1700000000000000000, Size: 35}
+	assert.Equal(t, pos1, DecodeLogRecordPos(EncodeLogRecordPos(pos1)))
+
+	// 旧版本编码中没有过期时间
+	buf := make([]byte, binary.MaxVarintLen64*2)
+	n := binary.PutVarint(buf, 3)
+	n += binary.PutVarint(buf[n:], 1024)
+	pos2 := DecodeLogRecordPos(buf[:n])
+	assert.Equal(t, &LogRecordPos{Fid: 3, Offset: 1024}, pos2)
+
+	// 旧版本编码中有过期时间，没有数据长度
+	buf = make([]byte, binary.MaxVarintLen64*3)
+	n = binary.PutVarint(buf, 3)
+	n += binary.PutVarint(buf[n:], 1024)
+	n += binary.PutVarint(buf[n:], 1700000000000000000)
+	pos3 := DecodeLogRecordPos(buf[:n])
+	assert.Equal(t, &LogRecordPos{Fid: 3, Offset: 1024, Expire: 1700000000000000000}, pos3)
+}
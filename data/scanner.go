@@ -0,0 +1,192 @@
+package data
+
+import (
+	"bitcask/fio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownFileType = errors.New("不是数据目录中的文件")
+
+// FileType 数据目录中的文件类型，决定了记录中的 key 与 value 如何解释
+type FileType int8
+
+const (
+	DataFileType          FileType = iota + 1 // <fileId>.data，key 带有事务序列号
+	HintFileType                              // hint-index，value 是 LogRecordPos
+	MergeFinishedFileType                     // merge-finished，value 是没有参与 merge 的第一个文件 id
+	SeqNoFileType                             // seq-no，value 是关闭时的事务序列号
+	FileHintType                              // <fileId>.hint，key 带有事务序列号，value 是 LogRecordPos
+)
+
+func (t FileType) String() string {
+	switch t {
+	case DataFileType:
+		return "data"
+	case HintFileType:
+		return HintFileName
+	case MergeFinishedFileType:
+		return MergeFinishedFileName
+	case SeqNoFileType:
+		return SeqNoFileName
+	case FileHintType:
+		return "hint"
+	}
+	return "unknown"
+}
+
+// FileTypeOf 根据文件名判断文件类型
+func FileTypeOf(fileName string) (FileType, error) {
+	name := filepath.Base(fileName)
+	switch name {
+	case HintFileName:
+		return HintFileType, nil
+	case MergeFinishedFileName:
+		return MergeFinishedFileType, nil
+	case SeqNoFileName:
+		return SeqNoFileType, nil
+	}
+	for suffix, fileType := range map[string]FileType{
+		DataFileNameSuffix: DataFileType,
+		FileHintNameSuffix: FileHintType,
+	} {
+		if strings.HasSuffix(name, suffix) {
+			if _, err := strconv.Atoi(strings.TrimSuffix(name, suffix)); err == nil {
+				return fileType, nil
+			}
+		}
+	}
+	return 0, ErrUnknownFileType
+}
+
+// ScannedRecord 扫描出来的一条记录
+type ScannedRecord struct {
+	Offset int64
+	Size   int64 // 编码后占用的字节数
+	Type   LogRecordType
+	Expire int64
+	SeqNo  uint64 // 事务序列号，只有数据文件与 <fileId>.hint 才有
+	Key    []byte // 数据文件中已经去掉了序列号
+	Value  []byte
+	Pos    *LogRecordPos // hint-index 与 <fileId>.hint 中由 value 解码出的位置
+
+	// 这条记录读不出来（crc 校验失败、不完整等），此时只有 Offset 与 Size 有效
+	Err error
+}
+
+// RecordScanner 从头到尾逐条读取一个文件中的记录，用法与 bufio.Scanner 相同
+//
+//	for scanner.Scan() {
+//		record := scanner.Record()
+//	}
+//	if err := scanner.Err(); err != nil {
+//	}
+type RecordScanner struct {
+	dataFile *DataFile
+	fileType FileType
+	offset   int64
+	record   *ScannedRecord
+	done     bool
+	err      error
+}
+
+// NewRecordScanner 打开文件准备扫描，读取加密的数据需要传入 codec，否则可以为 nil
+func NewRecordScanner(fileName string, codec *Codec) (*RecordScanner, error) {
+	fileType, err := FileTypeOf(fileName)
+	if err != nil {
+		return nil, err
+	}
+	// 文件不存在时不能让 IOManager 新建出来
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+	dataFile, err := newDataFile(fileName, 0, fio.StandardFile)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.Codec = codec
+	return &RecordScanner{
+		dataFile: dataFile,
+		fileType: fileType,
+	}, nil
+}
+
+func (s *RecordScanner) FileType() FileType {
+	return s.fileType
+}
+
+// Scan 读取下一条记录，读到文件末尾或者出错时返回 false
+// 损坏的记录也会返回，记录的 Err 不为空，之后会继续读取下一条
+func (s *RecordScanner) Scan() bool {
+	if s.done {
+		return false
+	}
+
+	logRecord, size, err := s.dataFile.ReadLogRecord(s.offset)
+	if err == io.EOF {
+		s.done = true
+		return false
+	}
+	record := &ScannedRecord{Offset: s.offset, Size: size}
+	switch {
+	case err == io.ErrUnexpectedEOF || err == ErrInvalidCRC:
+		// 长度可能也损坏了，不能按它跳过，往后找到下一条完好的数据接着读
+		next, found, findErr := s.dataFile.NextLogRecordOffset(s.offset)
+		if findErr != nil {
+			s.err = findErr
+			s.done = true
+			return false
+		}
+		// 后面还有完好的数据，说明不是写到一半，而是中间的数据损坏了
+		if found {
+			err = ErrInvalidCRC
+		}
+		record.Size = next - s.offset
+		record.Err = err
+	case err != nil && size > 0:
+		record.Err = err
+	case err != nil:
+		s.err = err
+		s.done = true
+		return false
+	default:
+		record.Type = logRecord.Type
+		record.Expire = logRecord.Expire
+		record.Key = logRecord.Key
+		record.Value = logRecord.Value
+		switch s.fileType {
+		case DataFileType:
+			record.Key, record.SeqNo = ParseLogRecordKey(logRecord.Key)
+		case HintFileType:
+			record.Pos = DecodeLogRecordPos(logRecord.Value)
+		case FileHintType:
+			record.Key, record.SeqNo = ParseLogRecordKey(logRecord.Key)
+			// 最后一条记录的是数据文件的大小与 crc，不是位置
+			if !isFileHintChecksum(logRecord) {
+				record.Pos = DecodeLogRecordPos(logRecord.Value)
+			}
+		}
+	}
+
+	s.offset += record.Size
+	s.record = record
+	return true
+}
+
+// Record 最近一次 Scan 读到的记录
+func (s *RecordScanner) Record() *ScannedRecord {
+	return s.record
+}
+
+// Err 扫描中途遇到的错误，正常读到文件末尾时为 nil
+func (s *RecordScanner) Err() error {
+	return s.err
+}
+
+func (s *RecordScanner) Close() error {
+	return s.dataFile.Close()
+}
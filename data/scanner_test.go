@@ -0,0 +1,104 @@
+package data
+
+import (
+	"bitcask/fio"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordScanner(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-scanner")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 3, fio.StandardFile)
+	assert.Nil(t, err)
+
+	log1, size1 := EncodeLogRecord(&LogRecord{Key: LogRecordKeyWithSeq([]byte("name"), 0), Value: []byte("bitcask-go")})
+	log2, size2 := EncodeLogRecord(&LogRecord{Key: LogRecordKeyWithSeq([]byte("name"), 7), Type: LogRecordDeleted})
+	assert.Nil(t, dataFile.Write(log1))
+	assert.Nil(t, dataFile.Write(log2))
+	log2[size2-1]++
+	assert.Nil(t, dataFile.Write(log2))
+	assert.Nil(t, dataFile.Write(log1))
+	assert.Nil(t, dataFile.Write(log1[:8]))
+	assert.Nil(t, dataFile.Close())
+
+	scanner, err := NewRecordScanner(GetDataFileName(dir, 3), nil)
+	assert.Nil(t, err)
+	defer scanner.Close()
+	assert.Equal(t, DataFileType, scanner.FileType())
+
+	var records []*ScannedRecord
+	for scanner.Scan() {
+		records = append(records, scanner.Record())
+	}
+	assert.Nil(t, scanner.Err())
+	assert.Equal(t, 5, len(records))
+
+	assert.Equal(t, []byte("name"), records[0].Key)
+	assert.Equal(t, []byte("bitcask-go"), records[0].Value)
+	assert.Equal(t, size1, records[0].Size)
+
+	assert.Equal(t, size1, records[1].Offset)
+	assert.Equal(t, LogRecordDeleted, records[1].Type)
+	assert.Equal(t, uint64(7), records[1].SeqNo)
+
+	// 损坏的记录也会返回，之后继续往下读
+	assert.Equal(t, ErrInvalidCRC, records[2].Err)
+	assert.Equal(t, size2, records[2].Size)
+	assert.Nil(t, records[3].Err)
+	assert.Equal(t, io.ErrUnexpectedEOF, records[4].Err)
+	assert.Equal(t, int64(8), records[4].Size)
+
+	// hint 文件中的 value 解码为位置
+	hintFile, err := OpenHintFile(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, hintFile.WriteHintRecord([]byte("name"), &LogRecordPos{Fid: 3, Offset: 100, Size: 20}))
+	assert.Nil(t, hintFile.Close())
+	scanner2, err := NewRecordScanner(filepath.Join(dir, HintFileName), nil)
+	assert.Nil(t, err)
+	defer scanner2.Close()
+	assert.True(t, scanner2.Scan())
+	assert.Equal(t, []byte("name"), scanner2.Record().Key)
+	assert.Equal(t, &LogRecordPos{Fid: 3, Offset: 100, Size: 20}, scanner2.Record().Pos)
+	assert.False(t, scanner2.Scan())
+
+	_, err = NewRecordScanner(filepath.Join(dir, "flock"), nil)
+	assert.Equal(t, ErrUnknownFileType, err)
+	_, err = NewRecordScanner(GetDataFileName(dir, 4), nil)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRecordScanner_Resync(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-scanner-resync")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFile)
+	assert.Nil(t, err)
+
+	// 中间一条数据的 keySize 损坏，按它的长度会跳过头
+	log1, size1 := EncodeLogRecord(&LogRecord{Key: LogRecordKeyWithSeq([]byte("name"), 0), Value: []byte("bitcask-go")})
+	assert.Nil(t, dataFile.Write(log1))
+	corrupted := append([]byte{}, log1...)
+	corrupted[5] = 0x7e
+	assert.Nil(t, dataFile.Write(corrupted))
+	assert.Nil(t, dataFile.Write(log1))
+	assert.Nil(t, dataFile.Close())
+
+	scanner, err := NewRecordScanner(GetDataFileName(dir, 0), nil)
+	assert.Nil(t, err)
+	defer scanner.Close()
+	var records []*ScannedRecord
+	for scanner.Scan() {
+		records = append(records, scanner.Record())
+	}
+	assert.Nil(t, scanner.Err())
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, ErrInvalidCRC, records[1].Err)
+	assert.Equal(t, size1, records[1].Size)
+	assert.Nil(t, records[2].Err)
+	assert.Equal(t, 2*size1, records[2].Offset)
+	assert.Equal(t, []byte("name"), records[2].Key)
+}
@@ -1,17 +1,23 @@
 package bitcask_go
 
 import (
+	"bitcask/cache"
 	"bitcask/data"
 	"bitcask/fio"
 	"bitcask/index"
+	"bitcask/utils"
 	"errors"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofrs/flock"
 )
@@ -19,7 +25,10 @@ import (
 // 给用户提供的接口
 
 const (
-	SeqNoKey     = "seq.no"
+	SeqNoKey = "seq.no"
+	// 与序列号一起写在序列号文件中，B+树模式下启动时不重放数据文件，从这里恢复可回收的空间
+	reclaimSizeKey = "reclaim.size"
+	// 写进程在这个文件上加排他锁，只读进程加共享锁，多个只读进程可以同时打开
 	fileLockName = "flock"
 )
 
@@ -29,8 +38,10 @@ type DB struct {
 	olderFiles map[uint32]*data.DataFile
 	options    Options
 	index      index.Indexer
-	fileIds    []int  // 仅用于加载索引
-	seqNo      uint64 // 事务序列号
+	codec      *data.Codec // 写入数据时的编码方式
+	cache      *cache.LRU  // 读缓存，没有开启时为 nil
+	fileIds    []int       // 仅用于加载索引
+	seqNo      uint64      // 事务序列号
 	isMerging  bool
 
 	// 因为B+树模式里，获取seqNo比较麻烦，
@@ -49,6 +60,62 @@ type DB struct {
 
 	fileLock   *flock.Flock
 	bytesWrite int // 当前写入的字节数，辅助数据持久化做阈值判断
+	// 已失效的数据所占的字节数，即 merge 后可以回收的空间
+	// B+树模式下关闭时写入序列号文件，上次没有正常关闭时从 0 开始统计
+	reclaimSize int64
+
+	truncatedTail *TailTruncation // 启动时活跃文件尾部被截掉的数据
+
+	// 组提交：并发的写入在 commitQueue 中排队，由 leader 合并写入、一次持久化
+	commitMu    sync.Mutex
+	commitQueue []*commitRequest
+	committing  bool
+
+	// 活跃文件中每条数据的 hint，文件封存时写入 <fileId>.hint
+	// 启动时没有重放活跃文件（B+树模式）就无法得到完整的 hint，此时不写
+	activeHints         []*data.HintRecord
+	activeHintsComplete bool
+	activeCRC           uint32 // 活跃文件已写入内容的 crc，和 hint 一起写入，启动时用来校验封存的文件
+
+	// 自动 merge 相关
+	// merge 的结果要等下次启动才生效，mergePending 表示已经有 merge 完成、还没生效，
+	// 在那之前自动 merge 不再执行，避免对同一批数据反复 merge
+	mergePending bool
+	mergeLoaded  bool // 启动时有 merge 生效，序列号文件中记录的可回收空间已经不准了
+	closeCh      chan struct{}
+	closeOnce    sync.Once
+	autoMergeWg  sync.WaitGroup
+
+	// 还没有关闭的快照（包括事务中的），不为 0 时不能关闭数据库
+	// 快照没有关闭时数据文件也不能被 merge 的结果替换，而替换只发生在下次启动时
+	snapshots int64
+
+	// 乐观事务的冲突检测，只在有事务进行时给每次写入一个递增的版本号，记录每个 key 最近一次被修改时的版本
+	// 版本号只在内存中使用，和持久化的事务序列号无关
+	txnMu      sync.Mutex
+	txnVersion uint64
+	activeTxns map[*Txn]struct{}
+	txnWrites  map[string]uint64
+}
+
+// Stat 数据库的统计信息
+type Stat struct {
+	KeyNum          uint   // 索引中 key 的总数，过期的 key 在被覆盖、删除或 merge 之前也算在内
+	DataFileNum     uint   // 数据文件的数量
+	ReclaimableSize int64  // 可以通过 merge 回收的字节数
+	DiskSize        int64  // 数据目录所占的磁盘空间
+	CacheHits       uint64 // 读缓存命中的次数
+	CacheMisses     uint64 // 读缓存未命中的次数
+
+	TruncatedTail *TailTruncation // 启动时从活跃文件尾部丢弃的损坏数据，没有则为 nil
+}
+
+// TailTruncation 进程在写入途中崩溃时，活跃文件尾部会留下不完整的数据，
+// 启动时会把它截掉，这里记录截掉了哪些数据
+type TailTruncation struct {
+	FileId uint32 // 被截断的数据文件
+	Offset int64  // 截断的位置，即最后一条完整数据的末尾
+	Size   int64  // 丢弃的字节数
 }
 
 func Open(options Options) (*DB, error) {
@@ -59,6 +126,24 @@ func Open(options Options) (*DB, error) {
 	if err := checkOptions(options); err != nil {
 		return nil, err
 	}
+	codec, err := data.NewCodec(options.Compression, options.EncryptionKey, options.PreviousEncryptionKeys...)
+	if err != nil {
+		return nil, err
+	}
+	if options.InMemory {
+		return openInMemory(options, codec)
+	}
+
+	if options.ReadOnly {
+		// 只读模式不创建目录
+		if _, err := os.Stat(options.DirPath); err != nil {
+			return nil, err
+		}
+		// B+树索引文件被写进程独占，只读模式下改用内存索引
+		if options.IndexType == BPlusTree {
+			options.IndexType = Btree
+		}
+	}
 
 	var isInitial bool
 	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
@@ -75,8 +160,20 @@ func Open(options Options) (*DB, error) {
 		isInitial = true
 	}
 
+	// B+树索引文件不存在时（新建的数据库，或是从备份打开），需要从数据文件重建索引
+	var rebuildIndex = options.IndexType != BPlusTree
+	if !rebuildIndex {
+		_, err := os.Stat(filepath.Join(options.DirPath, index.BPTreeIndexFileName))
+		rebuildIndex = os.IsNotExist(err)
+	}
+
+	var hold bool
 	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
+	if options.ReadOnly {
+		hold, err = fileLock.TryRLock()
+	} else {
+		hold, err = fileLock.TryLock()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -88,9 +185,14 @@ func Open(options Options) (*DB, error) {
 		mu:         new(sync.RWMutex),
 		olderFiles: make(map[uint32]*data.DataFile),
 		options:    options,
-		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrite),
+		codec:      codec,
 		isInitial:  isInitial,
 		fileLock:   fileLock,
+		closeCh:    make(chan struct{}),
+	}
+
+	if options.CacheSize > 0 {
+		db.cache = cache.NewLRU(options.CacheSize)
 	}
 
 	// 加载merge文件
@@ -98,11 +200,20 @@ func Open(options Options) (*DB, error) {
 		return nil, err
 	}
 
+	// merge 生效后数据文件都换了，B+树索引中的位置全部失效，删掉之后从 hint 和数据文件重建
+	if db.mergeLoaded && options.IndexType == BPlusTree && !rebuildIndex {
+		if err := os.Remove(filepath.Join(options.DirPath, index.BPTreeIndexFileName)); err != nil {
+			return nil, err
+		}
+		rebuildIndex = true
+	}
+	db.index = index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrite)
+
 	if err := db.loadDataFiles(); err != nil {
 		return nil, err
 	}
 
-	if options.IndexType != BPlusTree {
+	if rebuildIndex {
 		if err := db.loadIndexFromHintFile(); err != nil {
 			return nil, err
 		}
@@ -110,53 +221,98 @@ func Open(options Options) (*DB, error) {
 		if err := db.loadIndexFromDataFiles(); err != nil {
 			return nil, err
 		}
-		if db.options.MMapStartup {
-			if err := db.resetDataFileIOType(); err != nil {
+
+		// B+树模式下没有索引文件（比如从备份恢复）时重放了数据文件，序列号已经是准确的
+		// 留下的序列号文件不再需要，删掉以免之后读到旧的序列号
+		if options.IndexType == BPlusTree {
+			if err := db.removeSeqNoFile(); err != nil {
 				return nil, err
 			}
+			db.seqFileExists = true
 		}
 	}
 
-	if db.options.IndexType == BPlusTree {
+	if db.options.MMapStartup {
+		if err := db.resetDataFileIOType(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 截掉活跃文件尾部不完整的数据，B+树模式下没有重放数据文件，需要单独检查
+	if !rebuildIndex && db.activeFile != nil {
+		if err := db.checkActiveFileTail(); err != nil {
+			return nil, err
+		}
+	}
+	// 只读模式下尾部可能是写进程正在写的数据，只跳过不截断
+	if db.truncatedTail != nil && !db.options.ReadOnly {
+		if err := db.activeFile.Truncate(db.truncatedTail.Offset); err != nil {
+			return nil, err
+		}
+	}
+
+	// 尾部截断之后，活跃文件再换成可写的内存映射
+	if db.activeFile != nil && db.options.IOType == MMapIO && !db.options.ReadOnly {
+		if err := db.setIOManager(db.activeFile, MMapIO); err != nil {
+			return nil, err
+		}
+	}
+
+	if !rebuildIndex {
 		if err := db.loadSeqNo(); err != nil {
 			return nil, err
 		}
-		if db.activeFile != nil {
-			size, err := db.activeFile.IOManager.Size()
-			if err != nil {
+		// 旧版本的 B+树索引没有记录数据长度
+		if bpt, ok := db.index.(*index.BPlusTree); ok {
+			if err := bpt.MigratePosSize(db.readRecordSize); err != nil {
 				return nil, err
 			}
-			db.activeFile.WOffset = size
 		}
 	}
 
+	if db.options.MergeCheckInterval > 0 && !db.options.ReadOnly {
+		db.autoMergeWg.Add(1)
+		go db.autoMerge()
+	}
+
 	return db, nil
 
 }
 
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.PutWithTTL(key, value, 0)
+}
+
+// PutWithTTL 写入一条会在 ttl 之后过期的数据，ttl <= 0 时永不过期
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
 	// 添加索引，更新索引
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
-
-	logRecord := &data.LogRecord{
-		Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
+	if db.options.ReadOnly {
+		return ErrReadOnly
 	}
 
-	pos, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return err
+	var expire int64
+	if ttl > 0 {
+		expire = time.Now().Add(ttl).UnixNano()
 	}
 
-	// 更新索引
-	if ok := db.index.Put(key, pos); !ok {
-		return ErrIndexUpdateFailed
+	logRecord := &data.LogRecord{
+		Key:    logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:  value,
+		Type:   data.LogRecordNormal,
+		Expire: expire,
 	}
 
-	return nil
+	return db.commit([]*data.LogRecord{logRecord}, db.options.SyncWrite, func(positions []*data.LogRecordPos) error {
+		// 更新索引，被覆盖的旧数据可以回收
+		if oldPos := db.index.Put(key, positions[0]); oldPos != nil {
+			atomic.AddInt64(&db.reclaimSize, int64(oldPos.Size))
+			db.evictCache(oldPos)
+		}
+		return nil
+	})
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
@@ -169,23 +325,45 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	}
 
 	logRecordPos := db.index.Get(key)
-	if logRecordPos == nil {
+	if logRecordPos == nil || isExpired(logRecordPos.Expire) {
 		return nil, ErrKeyNotFound
 	}
 
+	// 封存活跃文件时会在 db.mu 下换掉 IOManager，内存映射也会被解除
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return db.getValueByPostion(logRecordPos)
 
 }
 
+// Exists 只查索引判断 key 是否存在，不读取数据文件
+func (db *DB) Exists(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	pos := db.index.Get(key)
+	return pos != nil && !isExpired(pos.Expire)
+}
+
 func (db *DB) Delete(key []byte) error {
+	_, err := db.Remove(key)
+	return err
+}
+
+// Remove 与 Delete 相同，同时返回 key 在删除之前是否存在，已经过期的不算
+// 并发删除同一个 key 时只有一个会返回 true
+func (db *DB) Remove(key []byte) (bool, error) {
 	// 和put一样的逻辑，不过是没有value
 
 	if len(key) == 0 {
-		return ErrKeyIsEmpty
+		return false, ErrKeyIsEmpty
+	}
+	if db.options.ReadOnly {
+		return false, ErrReadOnly
 	}
 
 	if pos := db.index.Get(key); pos == nil {
-		return nil
+		return false, nil
 	}
 
 	logRecord := &data.LogRecord{
@@ -193,25 +371,34 @@ func (db *DB) Delete(key []byte) error {
 		Type: data.LogRecordDeleted,
 	}
 
-	_, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return nil
-	}
+	var deleted bool
+	err := db.commit([]*data.LogRecord{logRecord}, db.options.SyncWrite, func(positions []*data.LogRecordPos) error {
+		// 删除记录本身在 merge 时也会被丢掉
+		atomic.AddInt64(&db.reclaimSize, int64(positions[0].Size))
 
-	if ok := db.index.Delete(key); !ok {
-		return ErrIndexUpdateFailed
-	}
-	return nil
+		// 并发的删除已经先一步删掉了
+		oldPos, ok := db.index.Delete(key)
+		if !ok {
+			return nil
+		}
+		deleted = !isExpired(oldPos.Expire)
+		atomic.AddInt64(&db.reclaimSize, int64(oldPos.Size))
+		db.evictCache(oldPos)
+		return nil
+	})
+	return deleted, err
 }
 
 // ListKeys 获取数据库中所有的 key
 func (db *DB) ListKeys() [][]byte {
 	i := db.index.Iterator(false)
-	keys := make([][]byte, db.index.Size())
-	var index int
+	defer i.Close()
+	keys := make([][]byte, 0, db.index.Size())
 	for i.Rewind(); i.Valid(); i.Next() {
-		keys[index] = i.Key()
-		index++
+		if isExpired(i.Value().Expire) {
+			continue
+		}
+		keys = append(keys, i.Key())
 	}
 	return keys
 }
@@ -224,6 +411,9 @@ func (db *DB) Fold(f func(key []byte, value []byte) bool) error {
 	i := db.index.Iterator(false)
 	defer i.Close()
 	for i.Rewind(); i.Valid(); i.Next() {
+		if isExpired(i.Value().Expire) {
+			continue
+		}
 		value, err := db.getValueByPostion(i.Value())
 		if err != nil {
 			return err
@@ -236,6 +426,34 @@ func (db *DB) Fold(f func(key []byte, value []byte) bool) error {
 	return nil
 }
 
+// Stat 返回数据库的统计信息
+func (db *DB) Stat() (*Stat, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var dataFileNum = uint(len(db.olderFiles))
+	if db.activeFile != nil {
+		dataFileNum += 1
+	}
+
+	diskSize, err := db.diskSize()
+	if err != nil {
+		return nil, err
+	}
+
+	stat := &Stat{
+		KeyNum:          uint(db.index.Size()),
+		DataFileNum:     dataFileNum,
+		ReclaimableSize: atomic.LoadInt64(&db.reclaimSize),
+		DiskSize:        diskSize,
+		TruncatedTail:   db.truncatedTail,
+	}
+	if db.cache != nil {
+		stat.CacheHits, stat.CacheMisses = db.cache.Stats()
+	}
+	return stat, nil
+}
+
 // Sync TODO
 func (db *DB) Sync() error {
 	if db.activeFile == nil {
@@ -249,10 +467,23 @@ func (db *DB) Sync() error {
 
 // Close 关闭数据库
 func (db *DB) Close() error {
+	// 快照还在读数据文件，不等它们关闭，否则忘记关闭的快照会让这里一直卡住
+	if atomic.LoadInt64(&db.snapshots) > 0 {
+		return ErrSnapshotsOpen
+	}
+
 	defer func() {
-		_ = db.fileLock.Unlock()
+		if db.fileLock != nil {
+			_ = db.fileLock.Unlock()
+		}
 	}()
 
+	// 先停掉后台 merge，等正在进行的 merge 结束
+	db.closeOnce.Do(func() {
+		close(db.closeCh)
+	})
+	db.autoMergeWg.Wait()
+
 	// 关闭或与文件和旧数据文件
 	if db.activeFile == nil {
 		return nil
@@ -264,23 +495,31 @@ func (db *DB) Close() error {
 		return err
 	}
 
-	file, err := data.OpenSeqNoFile(db.options.DirPath)
-	if err != nil {
-		return err
-	}
+	// 只读模式与内存模式不写序列号文件
+	if !db.options.ReadOnly && !db.options.InMemory {
+		file, err := data.OpenSeqNoFile(db.options.DirPath)
+		if err != nil {
+			return err
+		}
 
-	logRecord := &data.LogRecord{
-		Key:   []byte(SeqNoKey),
-		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
-	}
+		logRecord := &data.LogRecord{
+			Key:   []byte(SeqNoKey),
+			Value: []byte(strconv.FormatUint(db.seqNo, 10)),
+		}
+		reclaimRecord := &data.LogRecord{
+			Key:   []byte(reclaimSizeKey),
+			Value: []byte(strconv.FormatInt(atomic.LoadInt64(&db.reclaimSize), 10)),
+		}
 
-	encLogRecord, _ := data.EncodeLogRecord(logRecord)
-	if err := file.Write(encLogRecord); err != nil {
-		return err
-	}
+		encLogRecord, _ := data.EncodeLogRecord(logRecord)
+		encReclaimRecord, _ := data.EncodeLogRecord(reclaimRecord)
+		if err := file.Write(append(encLogRecord, encReclaimRecord...)); err != nil {
+			return err
+		}
 
-	if err := file.Sync(); err != nil {
-		return err
+		if err := file.Sync(); err != nil {
+			return err
+		}
 	}
 
 	if err := db.activeFile.Close(); err != nil {
@@ -296,6 +535,14 @@ func (db *DB) Close() error {
 	return nil
 }
 
+// diskSize 数据占用的空间，内存模式下是所有数据文件的大小，调用方需要持有 db.mu 的读锁
+func (db *DB) diskSize() (int64, error) {
+	if db.options.InMemory {
+		return db.memorySize()
+	}
+	return utils.DirSize(db.options.DirPath)
+}
+
 // getValueByPostion 如函数名所说
 func (db *DB) getValueByPostion(pos *data.LogRecordPos) ([]byte, error) {
 	var dataFile *data.DataFile
@@ -304,85 +551,207 @@ func (db *DB) getValueByPostion(pos *data.LogRecordPos) ([]byte, error) {
 	} else {
 		dataFile = db.olderFiles[pos.Fid]
 	}
+	return db.readValue(dataFile, pos)
+}
+
+// readValue 从 dataFile 中读出 pos 处的 value，先查读缓存
+func (db *DB) readValue(dataFile *data.DataFile, pos *data.LogRecordPos) ([]byte, error) {
+	if db.cache != nil {
+		if value, ok := db.cache.Get(pos); ok {
+			return value, nil
+		}
+	}
 
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
 
-	logRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
+	var logRecord *data.LogRecord
+	var err error
+	if pos.Size > 0 {
+		// 知道数据长度，一次读出整条数据
+		logRecord, err = dataFile.ReadLogRecordAt(pos.Offset, int64(pos.Size))
+	} else {
+		logRecord, _, err = dataFile.ReadLogRecord(pos.Offset)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if db.cache != nil {
+		db.cache.Put(pos, logRecord.Value)
+	}
 	return logRecord.Value, nil
 }
 
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(logRecord)
+// evictCache 数据被覆盖或删除后，旧位置不会再被读到，从缓存中去掉
+// 同一位置上的数据不会改变，所以不去掉也不会读到错误的值，这里只是为了及时腾出空间
+func (db *DB) evictCache(pos *data.LogRecordPos) {
+	if db.cache != nil {
+		db.cache.Remove(pos)
+	}
+}
+
+// readRecordSize 从数据文件中读出 pos 处数据编码后的长度，用于补全旧版本索引中缺少的 Size
+func (db *DB) readRecordSize(pos *data.LogRecordPos) (uint32, error) {
+	var dataFile *data.DataFile
+	if db.activeFile != nil && db.activeFile.FileId == pos.Fid {
+		dataFile = db.activeFile
+	} else {
+		dataFile = db.olderFiles[pos.Fid]
+	}
+	if dataFile == nil {
+		return 0, ErrDataFileNotFound
+	}
+	_, size, err := dataFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(size), nil
 }
 
 // appendLogRecord 数据写入活跃文件，返回地址信息
+// 调用方需要持有 db.mu，或者像 merge 那样独占这个实例
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	// 若未初始化活跃文件，则新建
-	// 对数据二进制编码，调用DataFile的Write，将数据写入活跃文件
-	// 写入此条数据之后，若是超出活跃文件阈值，则创建新活跃文件
-	// 最后，根据编码后的偏移值计算出数据位置并返回
+	positions, err := db.writeLogRecords([]*data.LogRecord{logRecord})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.syncIfNeeded(db.options.SyncWrite); err != nil {
+		return nil, err
+	}
+	return positions[0], nil
+}
 
-	// 除此之外还可以给用户提供其他选择，比如是否当即持久化数据
+// writeLogRecords 把一组数据依次写入活跃文件，返回每条数据的地址信息，不负责持久化
+// 同一个活跃文件上的数据合成一次写入，写满了就换一个新的活跃文件接着写
+func (db *DB) writeLogRecords(logRecords []*data.LogRecord) ([]*data.LogRecordPos, error) {
+	// 若未初始化活跃文件，则新建
 	if db.activeFile == nil {
 		if err := db.setActiveFile(); err != nil {
 			return nil, err
 		}
 	}
 
-	enLogRecord, size := data.EncodeLogRecord(logRecord)
-
-	if db.activeFile.WOffset+size > db.options.DataFileSize {
-		// 写入此条日志后，是否超出活跃文件阈值？
-		// 若是，首先持久化当前活跃文件
-		// 其次，将活跃文件加入旧数据文件
-		// 最后，创建新活跃文件
+	positions := make([]*data.LogRecordPos, 0, len(logRecords))
+	var buf []byte
+	var hints []*data.HintRecord
+	// 写入成功之后才记到活跃文件的 hint 中
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		if err := db.activeFile.Write(buf); err != nil {
+			return err
+		}
+		db.bytesWrite += len(buf)
+		if db.activeHintsComplete {
+			db.activeHints = append(db.activeHints, hints...)
+			db.activeCRC = crc32.Update(db.activeCRC, crc32.IEEETable, buf)
+		}
+		buf, hints = buf[:0], hints[:0]
+		return nil
+	}
 
-		if err := db.activeFile.Sync(); err != nil {
+	for _, logRecord := range logRecords {
+		enLogRecord, size, err := db.codec.EncodeLogRecord(logRecord)
+		if err != nil {
 			return nil, err
 		}
 
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
+		// 写入此条日志后超出活跃文件阈值，先把已经编码好的写进去，再封存当前活跃文件
+		if db.activeFile.WOffset+int64(len(buf))+size > db.options.DataFileSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			if err := db.rotateActiveFile(); err != nil {
+				return nil, err
+			}
+		}
 
-		if err := db.setActiveFile(); err != nil {
-			return nil, err
+		pos := &data.LogRecordPos{
+			Fid:    db.activeFile.FileId,
+			Offset: db.activeFile.WOffset + int64(len(buf)),
+			Expire: logRecord.Expire,
+			Size:   uint32(size),
 		}
+		buf = append(buf, enLogRecord...)
+		hints = append(hints, &data.HintRecord{Key: logRecord.Key, Type: logRecord.Type, Pos: pos})
+		positions = append(positions, pos)
 	}
 
-	wOffset := db.activeFile.WOffset
-
-	if err := db.activeFile.Write(enLogRecord); err != nil {
+	if err := flush(); err != nil {
 		return nil, err
 	}
+	return positions, nil
+}
 
-	db.bytesWrite += int(size)
-	var needSync = db.options.SyncWrite
+// syncIfNeeded force 为 true，或者没有持久化的数据量达到 BytesPerSync 时持久化活跃文件
+func (db *DB) syncIfNeeded(force bool) error {
+	var needSync = force
 	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
 		needSync = true
 	}
+	if !needSync || db.activeFile == nil {
+		return nil
+	}
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	db.bytesWrite = 0
+	return nil
+}
 
-	if needSync {
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
+// rotateActiveFile 封存当前活跃文件并写入它的 hint，之后的写入落在新的活跃文件上
+func (db *DB) rotateActiveFile() error {
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	if db.activeHintsComplete {
+		err := data.WriteFileHint(db.options.DirPath, db.activeFile.FileId, db.activeHints,
+			db.activeFile.WOffset, db.activeCRC, db.codec)
+		if err != nil {
+			return err
 		}
-		if db.bytesWrite > 0 {
-			db.bytesWrite = 0
+	}
+
+	// 封存的文件只读，换回标准文件 IO，内存映射关闭时会截掉预分配的空间
+	if db.options.IOType == MMapIO {
+		if err := db.setIOManager(db.activeFile, StandardFileIO); err != nil {
+			return err
 		}
 	}
 
-	pos := &data.LogRecordPos{
-		Fid:    db.activeFile.FileId,
-		Offset: wOffset,
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	return db.setActiveFile()
+}
+
+// setIOManager 关闭数据文件当前的 IOManager，换成 ioType 对应的
+func (db *DB) setIOManager(dataFile *data.DataFile, ioType IOType) error {
+	if err := dataFile.IOManager.Close(); err != nil {
+		return err
+	}
+	fileName := data.GetDataFileName(db.options.DirPath, dataFile.FileId)
+	var ioManager fio.IOManager
+	var err error
+	if ioType == MMapIO {
+		ioManager, err = fio.NewWritableMMapIOManager(fileName, db.options.DataFileSize)
+	} else {
+		ioManager, err = fio.NewIOManager(fileName, ioType)
 	}
+	if err != nil {
+		return err
+	}
+	dataFile.IOManager = ioManager
+	db.wrapIOManager(dataFile)
+	return nil
+}
 
-	return pos, nil
+func (db *DB) wrapIOManager(dataFile *data.DataFile) {
+	if db.options.ioManagerWrapper != nil {
+		fileName := data.GetDataFileName(db.options.DirPath, dataFile.FileId)
+		dataFile.IOManager = db.options.ioManagerWrapper(fileName, dataFile.IOManager)
+	}
 }
 
 func (db *DB) setActiveFile() error {
@@ -392,12 +761,28 @@ func (db *DB) setActiveFile() error {
 	}
 
 	// 打开数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initFileId, fio.StandardFile)
+	var ioType = fio.StandardFile
+	if db.options.InMemory {
+		ioType = fio.InMemory
+	}
+	dataFile, err := data.OpenDataFile(db.options.DirPath, initFileId, ioType)
 	if err != nil {
 		return err
 	}
+	dataFile.Codec = db.codec
+	if db.options.IOType == MMapIO {
+		if err := db.setIOManager(dataFile, MMapIO); err != nil {
+			return err
+		}
+	} else {
+		db.wrapIOManager(dataFile)
+	}
 
 	db.activeFile = dataFile
+	db.activeHints = nil
+	db.activeCRC = 0
+	// 内存模式下没有文件可写，不记录 hint
+	db.activeHintsComplete = !db.options.InMemory
 
 	return nil
 }
@@ -436,6 +821,11 @@ func (db *DB) loadDataFiles() error {
 		if err != nil {
 			return nil
 		}
+		dataFile.Codec = db.codec
+		// 只读的内存映射稍后会被换掉
+		if ioType == fio.StandardFile {
+			db.wrapIOManager(dataFile)
+		}
 		if i == len(fileIds)-1 {
 			db.activeFile = dataFile
 		} else {
@@ -453,15 +843,27 @@ func (db *DB) loadIndexFromDataFiles() error {
 		return nil
 	}
 
+	// 已经 merge 过的文件，其索引从 hint 文件中加载即可
+	var nonMergeFileId uint32
+	if _, err := os.Stat(filepath.Join(db.options.DirPath, data.MergeFinishedFileName)); err == nil {
+		fileId, err := db.getNonMergeFileId(db.options.DirPath)
+		if err != nil {
+			return err
+		}
+		nonMergeFileId = fileId
+	}
+
 	update := func(k []byte, t data.LogRecordType, pos *data.LogRecordPos) {
-		var ok bool
-		if t == data.LogRecordNormal {
-			ok = db.index.Put(k, pos)
+		var oldPos *data.LogRecordPos
+		if t == data.LogRecordNormal && !isExpired(pos.Expire) {
+			oldPos = db.index.Put(k, pos)
 		} else {
-			ok = db.index.Delete(k)
+			// 已过期的数据等同于被删除，之前可能已因过期没进索引，所以不检查删除结果
+			oldPos, _ = db.index.Delete(k)
+			db.reclaimSize += int64(pos.Size)
 		}
-		if !ok {
-			panic("启动更新索引时失败")
+		if oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
 		}
 	}
 
@@ -470,105 +872,315 @@ func (db *DB) loadIndexFromDataFiles() error {
 
 	var currentSeqNo = nonTransactionSeqNo
 
-	for i, fid := range db.fileIds {
+	// 数据文件与 hint 中的数据都按这个逻辑重放
+	apply := func(key []byte, t data.LogRecordType, logRecordPos *data.LogRecordPos) {
+		realKey, seqNo := parseLogRecordKey(key)
+
+		// 更新索引
+		if seqNo == nonTransactionSeqNo {
+			update(realKey, t, logRecordPos)
+		} else {
+			if t == data.LogRecordTxnFinished {
+				for _, tRecord := range transactionRecords[seqNo] {
+					update(tRecord.Record.Key, tRecord.Record.Type, tRecord.Pos)
+				}
+				delete(transactionRecords, seqNo)
+				db.reclaimSize += int64(logRecordPos.Size)
+			} else {
+				transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
+					Record: &data.LogRecord{Key: realKey, Type: t},
+					Pos:    logRecordPos,
+				})
+			}
+		}
+
+		// 事务序列号更新
+		if seqNo > currentSeqNo {
+			currentSeqNo = seqNo
+		}
+	}
+
+	var dataFiles []*data.DataFile
+	for _, fid := range db.fileIds {
 		var fileId = uint32(fid)
-		var dataFile *data.DataFile
+		if fileId < nonMergeFileId {
+			continue
+		}
 		if fileId == db.activeFile.FileId {
-			dataFile = db.activeFile
+			dataFiles = append(dataFiles, db.activeFile)
 		} else {
-			dataFile = db.olderFiles[fileId]
+			dataFiles = append(dataFiles, db.olderFiles[fileId])
+		}
+	}
+
+	// 多个协程同时解析数据文件，这里再按文件 id 的顺序重放，结果与逐个读取完全一样
+	// 同一时刻最多有 workers 个文件的结果没被取走，避免一次把所有文件都读进内存
+	workers := db.options.LoadIndexWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	results := make([]chan *parsedDataFile, len(dataFiles))
+	for i := range results {
+		results[i] = make(chan *parsedDataFile, 1)
+	}
+	tokens := make(chan struct{}, workers)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, dataFile := range dataFiles {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int, dataFile *data.DataFile) {
+				results[i] <- db.parseDataFile(dataFile)
+			}(i, dataFile)
+		}
+	}()
+
+	for i, dataFile := range dataFiles {
+		parsed := <-results[i]
+		<-tokens
+		if parsed.err != nil {
+			return parsed.err
+		}
+		for _, record := range parsed.records {
+			apply(record.Key, record.Type, record.Pos)
 		}
 
-		var offset int64 = 0
-		// 一条一条地取文件里的数据
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if dataFile == db.activeFile {
+			// 活跃文件的 hint 在封存时写入
+			db.activeHints = parsed.records
+			db.activeFile.WOffset = parsed.offset
+			crc, err := db.activeFile.Checksum(parsed.offset)
 			if err != nil {
-				if err == io.EOF {
-					break
-				}
 				return err
 			}
-
-			logRecordPos := &data.LogRecordPos{
-				Fid:    fileId,
-				Offset: offset,
+			db.activeCRC = crc
+			if err := db.markTruncatedTail(parsed.offset); err != nil {
+				return err
 			}
+		}
+	}
 
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
+	db.activeHintsComplete = true
 
-			// 更新索引
-			if seqNo == nonTransactionSeqNo {
-				update(realKey, logRecord.Type, logRecordPos)
-			} else {
-				if logRecord.Type == data.LogRecordTxnFinished {
-					for _, tRecord := range transactionRecords[seqNo] {
-						update(tRecord.Record.Key, tRecord.Record.Type, tRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
-			}
+	// 没有提交完成的事务数据永远不会生效
+	for _, tRecords := range transactionRecords {
+		for _, tRecord := range tRecords {
+			db.reclaimSize += int64(tRecord.Pos.Size)
+		}
+	}
 
-			// 事务序列号更新
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
-			}
+	// 更新事务序列号
+	db.seqNo = currentSeqNo
+	return nil
+}
+
+// parsedDataFile 一个数据文件中的所有数据（不含 value）
+type parsedDataFile struct {
+	records []*data.HintRecord
+	offset  int64 // 读到的位置，活跃文件尾部写到一半的数据从这里截断
+	err     error
+}
 
-			offset += size
+// parseDataFile 按顺序读出文件中的每一条数据，封存的文件有 hint 时只读 hint
+func (db *DB) parseDataFile(dataFile *data.DataFile) *parsedDataFile {
+	isActive := dataFile == db.activeFile
 
+	// hint 读取失败就退回去读数据文件
+	if !isActive {
+		if hints, err := data.ReadFileHint(db.options.DirPath, dataFile, db.options.VerifyFileHints); err == nil {
+			return &parsedDataFile{records: hints}
 		}
+	}
 
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WOffset = offset
+	parsed := &parsedDataFile{}
+	var offset int64 = 0
+	// 一条一条地取文件里的数据
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			// 只容忍活跃文件的最后一条数据损坏，旧数据文件出错直接报错
+			if isActive {
+				if ok, tailErr := db.isTornTail(dataFile, offset, err); tailErr != nil {
+					parsed.err = tailErr
+					return parsed
+				} else if ok {
+					break
+				}
+			}
+			parsed.err = corruptionError(err)
+			return parsed
 		}
+
+		parsed.records = append(parsed.records, &data.HintRecord{
+			Key:  logRecord.Key,
+			Type: logRecord.Type,
+			Pos: &data.LogRecordPos{
+				Fid:    dataFile.FileId,
+				Offset: offset,
+				Expire: logRecord.Expire,
+				Size:   uint32(size),
+			},
+		})
+		offset += size
 	}
+	parsed.offset = offset
+	return parsed
+}
 
-	// 更新事务序列号
-	db.seqNo = currentSeqNo
+// isTornTail 判断读取 offset 处数据时的错误，是否是活跃文件尾部写到一半的数据造成的
+func (db *DB) isTornTail(dataFile *data.DataFile, offset int64, err error) (bool, error) {
+	if err != io.ErrUnexpectedEOF && err != data.ErrInvalidCRC {
+		return false, nil
+	}
+	// 长度越界也可能是文件中间的 header 损坏了，后面还能找到完好的数据，就不是写到一半
+	_, found, findErr := dataFile.NextLogRecordOffset(offset)
+	if findErr != nil {
+		return false, findErr
+	}
+	return !found, nil
+}
+
+// corruptionError 数据读到一半就到了文件末尾，但不是尾部写到一半的情况，说明数据损坏了
+func corruptionError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return data.ErrInvalidCRC
+	}
+	return err
+}
+
+// markTruncatedTail 活跃文件中有效数据到 offset 为止，后面还有数据的话记录下来，稍后截掉
+func (db *DB) markTruncatedTail(offset int64) error {
+	fileSize, err := db.activeFile.IOManager.Size()
+	if err != nil {
+		return err
+	}
+	if offset < fileSize {
+		db.truncatedTail = &TailTruncation{
+			FileId: db.activeFile.FileId,
+			Offset: offset,
+			Size:   fileSize - offset,
+		}
+	}
 	return nil
 }
 
+// checkActiveFileTail 不重放数据文件时，单独找出活跃文件中有效数据的末尾
+func (db *DB) checkActiveFileTail() error {
+	var offset int64 = 0
+	for {
+		_, size, err := db.activeFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if ok, tailErr := db.isTornTail(db.activeFile, offset, err); tailErr != nil {
+				return tailErr
+			} else if ok {
+				break
+			}
+			return corruptionError(err)
+		}
+		offset += size
+	}
+	db.activeFile.WOffset = offset
+	return db.markTruncatedTail(offset)
+}
+
 func (db *DB) loadSeqNo() error {
 	filename := filepath.Join(db.options.DirPath, data.SeqNoFileName)
-	if _, err := os.Stat(filename); err != nil {
+	// 上次没有正常关闭，没有序列号文件
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
 
-	seqNoFile, err := data.OpenSeqNoFile(filename)
+	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
 	if err != nil {
 		return err
 	}
+	defer seqNoFile.Close()
 
-	encLogRecord, _, err := seqNoFile.ReadLogRecord(0)
+	encLogRecord, size, err := seqNoFile.ReadLogRecord(0)
 	if err != nil {
 		return err
 	}
 
-	seqNo, err := strconv.ParseUint(string(encLogRecord.Key), 10, 64)
+	seqNo, err := strconv.ParseUint(string(encLogRecord.Value), 10, 64)
 	if err != nil {
 		return err
 	}
 
+	// 旧版本的序列号文件中没有可回收的空间
+	if size < info.Size() && !db.mergeLoaded {
+		reclaimRecord, _, err := seqNoFile.ReadLogRecord(size)
+		if err != nil {
+			return err
+		}
+		reclaimSize, err := strconv.ParseInt(string(reclaimRecord.Value), 10, 64)
+		if err != nil {
+			return err
+		}
+		db.reclaimSize = reclaimSize
+	}
+
 	db.seqNo = seqNo
 	db.seqFileExists = true
 	return os.Remove(filename)
 }
 
+func (db *DB) removeSeqNoFile() error {
+	if db.options.ReadOnly {
+		return nil
+	}
+	err := os.Remove(filepath.Join(db.options.DirPath, data.SeqNoFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isExpired 判断过期时间是否已到，0 表示永不过期
+func isExpired(expire int64) bool {
+	return expire > 0 && expire <= time.Now().UnixNano()
+}
+
 func checkOptions(o Options) error {
-	if o.DirPath == "" {
+	if o.DirPath == "" && !o.InMemory {
 		return errors.New("DirPath 未配置")
 	}
 
+	if o.InMemory && o.ReadOnly {
+		return errors.New("内存模式不能只读打开")
+	}
+
 	if o.DataFileSize <= 0 {
 		return errors.New("DataFileSize 配置错误")
 	}
 
+	if o.MergeCheckInterval > 0 && (o.MergeRatio <= 0 || o.MergeRatio > 1) {
+		return errors.New("MergeRatio 配置错误")
+	}
+
+	if o.Compression != NoCompression {
+		if _, ok := data.LookupCompressor(o.Compression); !ok {
+			return errors.New("Compression 配置错误")
+		}
+	}
+
+	if o.IOType != StandardFileIO && o.IOType != MMapIO {
+		return errors.New("IOType 配置错误")
+	}
+
 	return nil
 }
 
@@ -586,6 +1198,7 @@ func (db *DB) resetDataFileIOType() error {
 		return err
 	}
 	db.activeFile.IOManager = ioManager
+	db.wrapIOManager(db.activeFile)
 
 	for _, file := range db.olderFiles {
 		if err := file.IOManager.Close(); err != nil {
@@ -596,6 +1209,7 @@ func (db *DB) resetDataFileIOType() error {
 			return nil
 		}
 		file.IOManager = ioManager
+		db.wrapIOManager(file)
 	}
 	return nil
 }
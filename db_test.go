@@ -1,11 +1,20 @@
 package bitcask_go
 
 import (
+	"bitcask/data"
+	"bitcask/index"
 	"bitcask/utils"
+	"bytes"
+	"encoding/binary"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
 )
 
 func destroyDB(db *DB) {
@@ -213,6 +222,56 @@ func TestDB_Delete(t *testing.T) {
 	assert.Equal(t, val1, val2)
 }
 
+func TestDB_Remove(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-remove")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	assert.True(t, db.Exists(utils.GetTestKey(1)))
+	assert.False(t, db.Exists([]byte("unknown key")))
+	assert.False(t, db.Exists(nil))
+
+	// 过期的 key 不算存在
+	err = db.PutWithTTL([]byte("tmp"), []byte("1"), 20*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(40 * time.Millisecond)
+	assert.False(t, db.Exists([]byte("tmp")))
+	deleted, err := db.Remove([]byte("tmp"))
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+
+	// 并发删除同一批 key，每个 key 只会被删掉一次
+	// 每次都持久化，让其他删除在 leader 写入期间排队
+	db.options.SyncWrite = true
+	var wg sync.WaitGroup
+	var count int64
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				deleted, err := db.Remove(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				if deleted {
+					atomic.AddInt64(&count, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1000), count)
+	assert.False(t, db.Exists(utils.GetTestKey(1)))
+	assert.Equal(t, 0, len(db.ListKeys()))
+}
+
 func TestDB_ListKeys(t *testing.T) {
 	opts := DefaultDBOptions
 	dir, _ := os.MkdirTemp("", "bitcask-go-list-keys")
@@ -325,3 +384,975 @@ func TestDB_FileLock(t *testing.T) {
 
 	db2.Close()
 }
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.未过期时正常读取
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), time.Hour)
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.RandomValue(24), 50*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(3), utils.RandomValue(24))
+	assert.Nil(t, err)
+	val1, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.NotNil(t, val1)
+
+	// 2.过期之后 Get、ListKeys、Fold、Iterator 都看不到
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 2, len(db.ListKeys()))
+
+	var folded int
+	err = db.Fold(func(key []byte, value []byte) bool {
+		assert.NotEqual(t, utils.GetTestKey(2), key)
+		folded++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, folded)
+
+	iter := db.NewIterator(DefaultIteratorOptions)
+	var iterated int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.NotEqual(t, utils.GetTestKey(2), iter.Key())
+		iterated++
+	}
+	iter.Close()
+	assert.Equal(t, 2, iterated)
+
+	// 3.重新 Put 之后过期时间被覆盖
+	err = db.Put(utils.GetTestKey(2), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(4), utils.RandomValue(24), 50*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	// 4.重启之后过期时间依旧有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 3, len(db2.ListKeys()))
+}
+
+func TestDB_Stat(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stat")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 100; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(9900), stat.KeyNum)
+	assert.Equal(t, uint(1), stat.DataFileNum)
+	assert.Equal(t, int64(0), stat.ReclaimableSize)
+	assert.Greater(t, stat.DiskSize, int64(0))
+
+	// 覆盖写与删除都会产生可回收的空间
+	for i := 100; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 1000; i < 2000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(8900), stat.KeyNum)
+	assert.Greater(t, stat.ReclaimableSize, int64(0))
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(2001), utils.RandomValue(128))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	stat2, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Greater(t, stat2.ReclaimableSize, stat.ReclaimableSize)
+
+	// 重启之后统计结果一致
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	stat3, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat2.KeyNum, stat3.KeyNum)
+	assert.Equal(t, stat2.ReclaimableSize, stat3.ReclaimableSize)
+
+	// 过期的 key 还在索引中，同样算在内
+	err = db2.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(128), 20*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(40 * time.Millisecond)
+	stat3, err = db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat2.KeyNum+1, stat3.KeyNum)
+}
+
+func TestDB_Stat_BPlusTree(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stat-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Greater(t, stat.ReclaimableSize, int64(0))
+
+	// 启动时不重放数据文件，可回收的空间从序列号文件中恢复
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	stat2, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat.KeyNum, stat2.KeyNum)
+	assert.Equal(t, stat.ReclaimableSize, stat2.ReclaimableSize)
+
+	// merge 生效之后重新统计
+	err = db2.Merge()
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db3)
+	stat3, err := db3.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat.KeyNum, stat3.KeyNum)
+	assert.Equal(t, int64(0), stat3.ReclaimableSize)
+}
+
+func TestDB_OpenWithTornTail(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-torn-tail")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	fileName := data.GetDataFileName(dir, 0)
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	validSize := info.Size()
+
+	// 1.最后一条数据只写了一半
+	enc, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(100), nonTransactionSeqNo),
+		Value: utils.RandomValue(24),
+	})
+	appendToFile(t, fileName, enc[:len(enc)/2])
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	stat, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.NotNil(t, stat.TruncatedTail)
+	assert.Equal(t, validSize, stat.TruncatedTail.Offset)
+	assert.Equal(t, int64(len(enc)/2), stat.TruncatedTail.Size)
+	assert.Equal(t, 100, len(db2.ListKeys()))
+
+	// 截断之后继续写入，重启后数据完好
+	err = db2.Put(utils.GetTestKey(100), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 2.最后一条数据长度完整但内容损坏
+	info, err = os.Stat(fileName)
+	assert.Nil(t, err)
+	validSize = info.Size()
+	enc[len(enc)-1]++
+	appendToFile(t, fileName, enc)
+
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	stat, err = db3.Stat()
+	assert.Nil(t, err)
+	assert.NotNil(t, stat.TruncatedTail)
+	assert.Equal(t, validSize, stat.TruncatedTail.Offset)
+	assert.Equal(t, 101, len(db3.ListKeys()))
+	err = db3.Close()
+	assert.Nil(t, err)
+
+	// 3.正常关闭后再打开，不会截断
+	db4, err := Open(opts)
+	assert.Nil(t, err)
+	stat, err = db4.Stat()
+	assert.Nil(t, err)
+	assert.Nil(t, stat.TruncatedTail)
+	err = db4.Close()
+	assert.Nil(t, err)
+
+	// 4.旧数据文件损坏，直接报错
+	opts.DataFileSize = validSize + 1
+	db5, err := Open(opts)
+	assert.Nil(t, err)
+	err = db5.Put(utils.GetTestKey(101), utils.RandomValue(24))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(db5.olderFiles))
+	err = db5.Close()
+	assert.Nil(t, err)
+	corruptFile(t, fileName, validSize-1)
+
+	// 默认只核对大小，大小没变时直接用 hint，读到这条数据时才会发现损坏
+	db6, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 102, len(db6.ListKeys()))
+	err = db6.Close()
+	assert.Nil(t, err)
+
+	// 完整校验时会发现数据文件对不上，改为读取数据文件
+	opts.VerifyFileHints = true
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+}
+
+func TestDB_OpenWithCorruptedHeader(t *testing.T) {
+	// 第一条数据的 keySize 损坏：解不出来，或者长度超出文件末尾
+	// 后面还有完好的数据，不能当成尾部写到一半而截掉整个文件
+	largeSize := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(largeSize, 1<<20)
+	for _, keySize := range [][]byte{{0x01}, largeSize[:n]} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-corrupted-header")
+		opts.DirPath = dir
+		db, err := Open(opts)
+		assert.Nil(t, err)
+
+		for i := 0; i < 100; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+			assert.Nil(t, err)
+		}
+		err = db.Close()
+		assert.Nil(t, err)
+
+		fileName := data.GetDataFileName(dir, 0)
+		info, err := os.Stat(fileName)
+		assert.Nil(t, err)
+		f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+		assert.Nil(t, err)
+		// keySize 之后的 valueSize 保持不变，header 本身还能解出来
+		valueSize := make([]byte, 1)
+		_, err = f.ReadAt(valueSize, 6)
+		assert.Nil(t, err)
+		_, err = f.WriteAt(append(keySize, valueSize...), 5)
+		assert.Nil(t, err)
+		assert.Nil(t, f.Close())
+
+		_, err = Open(opts)
+		assert.Equal(t, data.ErrInvalidCRC, err)
+		corrupted, err := os.Stat(fileName)
+		assert.Nil(t, err)
+		assert.Equal(t, info.Size(), corrupted.Size())
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func appendToFile(t *testing.T, fileName string, b []byte) {
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(b)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func corruptFile(t *testing.T, fileName string, offset int64) {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, offset)
+	assert.Nil(t, err)
+	b[0]++
+	_, err = f.WriteAt(b, offset)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	opts.DirPath = dir
+	opts.Compression = GzipCompression
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("bitcask-go"), 100)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), value)
+		assert.Nil(t, err)
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Less(t, stat.DiskSize, int64(1000*len(value)/10))
+
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	// 关掉压缩重启，之前压缩过的数据照样能读
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.Compression = NoCompression
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	// merge 会按照新的配置重写数据
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	stat2, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Greater(t, stat2.DiskSize, int64(1000*len(value)))
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	opts.Compression = 100
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	opts.DirPath = dir
+	opts.EncryptionKey = bytes.Repeat([]byte("a"), 32)
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 数据文件与 hint 文件里都看不到明文
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, file := range files {
+		content, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(content, utils.GetTestKey(10)), file.Name())
+	}
+
+	// 轮换密钥
+	oldKey := bytes.Repeat([]byte("a"), 32)
+	opts.EncryptionKey = bytes.Repeat([]byte("b"), 16)
+	opts.PreviousEncryptionKeys = [][]byte{oldKey}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+	err = db.Put(utils.GetTestKey(1000), utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// merge 之后旧密钥就不需要了
+	opts.PreviousEncryptionKeys = nil
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i <= 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_OpenReadOnly(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-only")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer os.RemoveAll(db.getMergeDirPath())
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 写进程还开着，只读模式打不开
+	roOpts := opts
+	roOpts.ReadOnly = true
+	_, err = Open(roOpts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	// 写进程 merge 之后关闭，merge 结果等下次写进程启动时才生效
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 多个只读进程可以同时打开，只读进程开着的时候写进程打不开
+	ro, err := Open(roOpts)
+	assert.Nil(t, err)
+	ro2, err := Open(roOpts)
+	assert.Nil(t, err)
+	_, err = Open(opts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+	err = ro2.Close()
+	assert.Nil(t, err)
+
+	_, err = os.Stat(ro.getMergeDirPath())
+	assert.Nil(t, err)
+	_, err = ro.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := ro.Get(utils.GetTestKey(600))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(600), val)
+	assert.Equal(t, 500, len(ro.ListKeys()))
+
+	assert.Equal(t, ErrReadOnly, ro.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Equal(t, ErrReadOnly, ro.Delete(utils.GetTestKey(1)))
+	assert.Equal(t, ErrReadOnly, ro.Merge())
+	wb := ro.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Equal(t, ErrReadOnly, wb.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Equal(t, ErrReadOnly, wb.Commit())
+
+	// 只读进程关闭时不写序列号文件
+	err = os.Remove(filepath.Join(dir, data.SeqNoFileName))
+	assert.Nil(t, err)
+	err = ro.Close()
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, data.SeqNoFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	// 只读进程退出之后，写进程重启时 merge 生效
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(db.getMergeDirPath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 500, len(db.ListKeys()))
+
+	// 只读和写入用的是同一个文件锁
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		assert.NotContains(t, entry.Name(), fileLockName+"-")
+	}
+
+	// 目录不存在时不会创建
+	roOpts.DirPath = filepath.Join(dir, "not-exist")
+	_, err = Open(roOpts)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_FileHint(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-hint")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	// 跨越文件的事务，以及没有提交的事务数据
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1000; i < 1500; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	_, err = db.appendLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(2000), 100),
+		Value: utils.RandomValue(64),
+	})
+	assert.Nil(t, err)
+	assert.Greater(t, len(db.olderFiles), 2)
+
+	// 每个封存的文件都有 hint，并且和数据文件对得上
+	for _, dataFile := range db.olderFiles {
+		_, err := data.ReadFileHint(dir, dataFile, true)
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(data.GetFileHintName(dir, db.activeFile.FileId))
+	assert.True(t, os.IsNotExist(err))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	stat, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1400), stat.KeyNum)
+	val, err := db2.Get(utils.GetTestKey(1200))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, val)
+	_, err = db2.Get(utils.GetTestKey(2000))
+	assert.Equal(t, ErrKeyNotFound, err)
+	seqNo := db2.seqNo
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 与不用 hint 时重放的结果一致
+	for fid := uint32(0); fid < uint32(stat.DataFileNum); fid++ {
+		_ = os.Remove(data.GetFileHintName(dir, fid))
+	}
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	stat3, err := db3.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat.KeyNum, stat3.KeyNum)
+	assert.Equal(t, stat.ReclaimableSize, stat3.ReclaimableSize)
+	assert.Equal(t, seqNo, db3.seqNo)
+
+	// 重启之后接着写的活跃文件，封存时的 hint 同样对得上
+	activeFileId := db3.activeFile.FileId
+	for i := 0; i < 1000; i++ {
+		err := db3.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	_, err = data.ReadFileHint(dir, db3.olderFiles[activeFileId], true)
+	assert.Nil(t, err)
+	err = db3.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_LoadIndexWorkers(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-load-workers")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i%1500), utils.RandomValue(32))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 300; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 0; i < 500; i++ {
+		err := wb.Put(utils.GetTestKey(i), utils.RandomValue(32))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 去掉 hint，全部从数据文件解析
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == data.FileHintNameSuffix {
+			assert.Nil(t, os.Remove(filepath.Join(dir, entry.Name())))
+		}
+	}
+
+	var stats []*Stat
+	var seqNos []uint64
+	for _, workers := range []int{1, 3, 16} {
+		opts.LoadIndexWorkers = workers
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		stats = append(stats, stat)
+		seqNos = append(seqNos, db.seqNo)
+		val, err := db.Get(utils.GetTestKey(100))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+		err = db.Close()
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, stats[0].DataFileNum, uint(10))
+	assert.Equal(t, uint(1500), stats[0].KeyNum)
+	for i := 1; i < len(stats); i++ {
+		assert.Equal(t, stats[0].KeyNum, stats[i].KeyNum)
+		assert.Equal(t, stats[0].ReclaimableSize, stats[i].ReclaimableSize)
+		assert.Equal(t, seqNos[0], seqNos[i])
+	}
+}
+
+func TestDB_MigratePosSize(t *testing.T) {
+	// merge 生成的 hint-index
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-pos-size")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 改写成旧版本的格式
+	hintFileName := filepath.Join(dir, data.HintFileName)
+	var records []*data.HintRecord
+	scanner, err := data.NewRecordScanner(hintFileName, nil)
+	assert.Nil(t, err)
+	for scanner.Scan() {
+		record := scanner.Record()
+		assert.NotZero(t, record.Pos.Size)
+		record.Pos.Size = 0
+		records = append(records, &data.HintRecord{Key: record.Key, Type: record.Type, Pos: record.Pos})
+	}
+	_ = scanner.Close()
+	assert.Equal(t, 100, len(records))
+	err = data.RewriteHintFile(dir, records, nil)
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		pos := db.index.Get(utils.GetTestKey(i))
+		assert.NotZero(t, pos.Size)
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	scanner, err = data.NewRecordScanner(hintFileName, nil)
+	assert.Nil(t, err)
+	for scanner.Scan() {
+		assert.NotZero(t, scanner.Record().Pos.Size)
+	}
+	_ = scanner.Close()
+
+	// B+树索引
+	opts2 := DefaultDBOptions
+	dir2, _ := os.MkdirTemp("", "bitcask-go-pos-size-bptree")
+	opts2.DirPath = dir2
+	opts2.IndexType = BPlusTree
+	db2, err := Open(opts2)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db2.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	tree, err := bbolt.Open(filepath.Join(dir2, index.BPTreeIndexFileName), 0644, nil)
+	assert.Nil(t, err)
+	err = tree.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("bitcask-index"))
+		var keys [][]byte
+		_ = bucket.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			return nil
+		})
+		for _, key := range keys {
+			pos := data.DecodeLogRecordPos(bucket.Get(key))
+			pos.Size = 0
+			if err := bucket.Put(key, data.EncodeLogRecordPos(pos)); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteBucket([]byte("bitcask-meta"))
+	})
+	assert.Nil(t, err)
+	err = tree.Close()
+	assert.Nil(t, err)
+
+	db2, err = Open(opts2)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		pos := db2.index.Get(utils.GetTestKey(i))
+		assert.NotZero(t, pos.Size)
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_Cache(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cache")
+	opts.DirPath = dir
+	opts.CacheSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("v1"))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("v1"), val)
+	}
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), stat.CacheHits)
+	assert.Equal(t, uint64(1), stat.CacheMisses)
+
+	// 修改返回的 value 不影响缓存
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	val[0] = 'x'
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// 覆盖、删除、事务提交之后读到的都是新数据
+	err = db.Put(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	_, _ = db.Get(utils.GetTestKey(2))
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	_, _ = db.Get(utils.GetTestKey(3))
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(3), []byte("v3"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), val)
+
+	// merge 之后重启，数据位置变了
+	err = db.Merge()
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v3"), val)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		switch i {
+		case 1:
+			assert.Equal(t, []byte("v2"), val)
+		case 2:
+			assert.Equal(t, ErrKeyNotFound, err)
+		case 3:
+			assert.Equal(t, []byte("v3"), val)
+		default:
+			assert.Equal(t, []byte("v1"), val)
+		}
+	}
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_MMapIO(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-io")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IOType = MMapIO
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.olderFiles), 0)
+	val, err := db.Get(utils.GetTestKey(1999))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, val)
+
+	// 活跃文件是预分配的，封存的文件截断到实际长度
+	activeName := data.GetDataFileName(dir, db.activeFile.FileId)
+	info, err := os.Stat(activeName)
+	assert.Nil(t, err)
+	assert.Equal(t, opts.DataFileSize, info.Size())
+	info, err = os.Stat(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, db.olderFiles[0].WOffset, info.Size())
+
+	// 没有关闭就崩溃了，尾部留下预分配的空白
+	err = db.Sync()
+	assert.Nil(t, err)
+	crashDir, _ := os.MkdirTemp("", "bitcask-go-mmap-io-crash")
+	defer os.RemoveAll(crashDir)
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.Name() == fileLockName {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		err = os.WriteFile(filepath.Join(crashDir, entry.Name()), b, 0644)
+		assert.Nil(t, err)
+	}
+	crashOpts := opts
+	crashOpts.DirPath = crashDir
+	crashDB, err := Open(crashOpts)
+	assert.Nil(t, err)
+	for i := 0; i < 2000; i++ {
+		_, err := crashDB.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = crashDB.Put(utils.GetTestKey(2000), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = crashDB.Close()
+	assert.Nil(t, err)
+
+	// 正常关闭时活跃文件也截断到实际长度
+	activeOffset := db.activeFile.WOffset
+	err = db.Close()
+	assert.Nil(t, err)
+	info, err = os.Stat(activeName)
+	assert.Nil(t, err)
+	assert.Equal(t, activeOffset, info.Size())
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	stat, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2000), stat.KeyNum)
+	assert.Nil(t, stat.TruncatedTail)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_MMapIO_ConcurrentGet(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-io-get")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.IOType = MMapIO
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 封存活跃文件时会解除内存映射，同时读取活跃文件中的数据不能出错
+	var written int64
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				n := int(atomic.LoadInt64(&written))
+				for i := max(n-10, 0); i < n; i++ {
+					val, err := db.Get(utils.GetTestKey(i))
+					assert.Nil(t, err)
+					assert.Equal(t, bytes.Repeat(utils.GetTestKey(i), 20), val)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), bytes.Repeat(utils.GetTestKey(i), 20))
+		assert.Nil(t, err)
+		atomic.StoreInt64(&written, int64(i+1))
+	}
+	close(done)
+	wg.Wait()
+	assert.Greater(t, len(db.olderFiles), 100)
+}
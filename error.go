@@ -9,5 +9,14 @@ var (
 	ErrDataFileNotFound  = errors.New("找不着数据文件")
 	ErrExceedMaxBatchNum = errors.New("提交数超出单批次最大量")
 	ErrMergeInProgress   = errors.New("当前正在merge")
+	ErrMergeTooLarge     = errors.New("merge 之后的数据文件比原来多，会和之后写入的数据文件编号冲突")
 	ErrDatabaseIsUsing   = errors.New("数据库正被使用")
+	ErrBackupDirNotEmpty = errors.New("备份目录不为空")
+	ErrReadOnly          = errors.New("数据库以只读模式打开，不能写入")
+	ErrRepairDirNotEmpty = errors.New("修复目录不为空")
+	ErrInMemory          = errors.New("内存模式不支持此操作")
+	ErrKeysOnly          = errors.New("迭代器只遍历key，不能读取value")
+	ErrTxnConflict       = errors.New("事务读取的数据已被其他写入修改")
+	ErrTxnClosed         = errors.New("事务已经提交或回滚")
+	ErrSnapshotsOpen     = errors.New("还有没关闭的快照或事务，不能关闭数据库")
 )
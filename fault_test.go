@@ -0,0 +1,318 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"bitcask/fio"
+	"bitcask/utils"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openFaultyDB 打开数据库，所有数据文件（包括 merge 时的）都经过 FaultInjector
+func openFaultyDB(t *testing.T, opts Options) (*DB, *fio.FaultInjector) {
+	fi := fio.NewFaultInjector()
+	opts.ioManagerWrapper = fi.Wrap
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	return db, fi
+}
+
+// crashDB 模拟进程崩溃：不关闭数据库，丢掉所有没有持久化的数据，释放文件锁
+func crashDB(t *testing.T, db *DB, fi *fio.FaultInjector) {
+	assert.Nil(t, fi.Crash())
+	assert.Nil(t, db.fileLock.Unlock())
+}
+
+func faultTestOptions(t *testing.T) Options {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-fault")
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+		_ = os.RemoveAll(dir + mergeDirName)
+	})
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	return opts
+}
+
+func TestFault_OpenRecovery(t *testing.T) {
+	opts := faultTestOptions(t)
+	db, fi := openFaultyDB(t, opts)
+
+	// 持久化之后写入的数据在崩溃时丢失
+	for i := 0; i < 50; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	err := db.Sync()
+	assert.Nil(t, err)
+	for i := 50; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	crashDB(t, db, fi)
+
+	db, fi = openFaultyDB(t, opts)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(50), stat.KeyNum)
+	assert.Nil(t, stat.TruncatedTail)
+
+	// 磁盘写满、只写了一半：返回错误，之后的写入不受影响
+	fi.FailWrite(1, syscall.ENOSPC)
+	err = db.Put(utils.GetTestKey(100), utils.RandomValue(24))
+	assert.Equal(t, syscall.ENOSPC, err)
+	fi.ShortWrite(1)
+	err = db.Put(utils.GetTestKey(101), utils.RandomValue(24))
+	assert.NotNil(t, err)
+	err = db.Put(utils.GetTestKey(102), utils.RandomValue(24))
+	assert.Nil(t, err)
+	for _, i := range []int{100, 101} {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	val, err := db.Get(utils.GetTestKey(102))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, val)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, fi = openFaultyDB(t, opts)
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(51), stat.KeyNum)
+	assert.Nil(t, stat.TruncatedTail)
+
+	// 持久化失败：写入会被回滚，下次成功的持久化不会把它带上
+	db.options.SyncWrite = true
+	fi.FailSync(1, nil)
+	err = db.Put(utils.GetTestKey(103), utils.RandomValue(24))
+	assert.Equal(t, fio.ErrInjectedFault, err)
+	_, err = db.Get(utils.GetTestKey(103))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db.Put(utils.GetTestKey(104), utils.RandomValue(24))
+	assert.Nil(t, err)
+
+	// 最后一条数据损坏，启动时截掉
+	fi.CorruptWrite(1)
+	err = db.Put(utils.GetTestKey(105), utils.RandomValue(24))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(105))
+	assert.NotNil(t, err)
+	crashDB(t, db, fi)
+
+	db, _ = openFaultyDB(t, opts)
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(52), stat.KeyNum)
+	assert.NotNil(t, stat.TruncatedTail)
+	for _, i := range []int{103, 105} {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	_, err = db.Get(utils.GetTestKey(104))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestFault_WriteBatchAtomicity(t *testing.T) {
+	opts := faultTestOptions(t)
+	opts.DataFileSize = 4 * 1024
+	db, fi := openFaultyDB(t, opts)
+	wbOpts := WriteBatchOptions{MaxBatchNum: 10000, SyncWrite: false}
+
+	commitBatch := func(from, to int) error {
+		wb := db.NewWriteBatch(wbOpts)
+		for i := from; i < to; i++ {
+			assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		}
+		return wb.Commit()
+	}
+	countKeys := func(from, to int) int {
+		var count int
+		for i := from; i < to; i++ {
+			if _, err := db.Get(utils.GetTestKey(i)); err == nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	err := commitBatch(0, 10)
+	assert.Nil(t, err)
+
+	// 跨越文件的事务在第二个文件上写失败，前一半已经封存在旧文件里
+	fi.FailWrite(2, syscall.ENOSPC)
+	err = commitBatch(100, 200)
+	assert.Equal(t, syscall.ENOSPC, err)
+	assert.Equal(t, 0, countKeys(100, 200))
+
+	// 只写了一半的事务
+	fi.ShortWrite(1)
+	err = commitBatch(200, 210)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, countKeys(200, 210))
+
+	// 写进去了但持久化失败，回滚掉
+	fi.FailSync(1, syscall.EIO)
+	wb := db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: 10000, SyncWrite: true})
+	for i := 210; i < 220; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Equal(t, syscall.EIO, wb.Commit())
+	assert.Equal(t, 0, countKeys(210, 220))
+
+	// 事务已经提交但没有持久化，崩溃时只留下了前一半
+	err = commitBatch(300, 400)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, countKeys(300, 400))
+	// 回滚过的活跃文件封存之后，hint 仍然和数据文件对得上
+	for _, dataFile := range db.olderFiles {
+		_, err := data.ReadFileHint(opts.DirPath, dataFile, true)
+		assert.Nil(t, err)
+	}
+	crashDB(t, db, fi)
+
+	db, _ = openFaultyDB(t, opts)
+	assert.Equal(t, 10, countKeys(0, 10))
+	assert.Equal(t, 0, countKeys(100, 400))
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(10), stat.KeyNum)
+
+	err = commitBatch(400, 410)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, _ = openFaultyDB(t, opts)
+	assert.Equal(t, 20, countKeys(0, 1000))
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestFault_GroupCommitAcrossFiles(t *testing.T) {
+	opts := faultTestOptions(t)
+	opts.DataFileSize = 4 * 1024
+	db, fi := openFaultyDB(t, opts)
+
+	// 直接构造一组合并提交的 Put
+	putGroup := func(from, to int) []*commitRequest {
+		var group []*commitRequest
+		for i := from; i < to; i++ {
+			key := utils.GetTestKey(i)
+			group = append(group, &commitRequest{
+				logRecords: []*data.LogRecord{{
+					Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
+					Value: utils.RandomValue(256),
+					Type:  data.LogRecordNormal,
+				}},
+				apply: func(positions []*data.LogRecordPos) error {
+					db.index.Put(key, positions[0])
+					return nil
+				},
+			})
+		}
+		return group
+	}
+	countKeys := func(from, to int) int {
+		var count int
+		for i := from; i < to; i++ {
+			if _, err := db.Get(utils.GetTestKey(i)); err == nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	// 写到一半换了活跃文件，在新文件上写失败，封存的旧文件里已经有这组数据的前一半
+	fi.FailWrite(2, syscall.ENOSPC)
+	group := putGroup(0, 20)
+	db.commitGroup(group)
+	for _, req := range group {
+		assert.Equal(t, syscall.ENOSPC, req.err)
+	}
+	assert.Equal(t, 1, len(db.olderFiles))
+	assert.Equal(t, 0, countKeys(0, 20))
+
+	// 跨越文件的一组写入成功
+	group = putGroup(100, 120)
+	db.commitGroup(group)
+	for _, req := range group {
+		assert.Nil(t, req.err)
+	}
+	assert.Equal(t, 20, countKeys(100, 120))
+	err := db.Sync()
+	assert.Nil(t, err)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	crashDB(t, db, fi)
+
+	// 重启之后失败的写入不会出现，成功的都在，可回收空间的统计一致
+	db, _ = openFaultyDB(t, opts)
+	assert.Equal(t, 0, countKeys(0, 20))
+	assert.Equal(t, 20, countKeys(100, 120))
+	stat2, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, stat.ReclaimableSize, stat2.ReclaimableSize)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestFault_MergeCrash(t *testing.T) {
+	opts := faultTestOptions(t)
+	db, fi := openFaultyDB(t, opts)
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 2000; i++ {
+		value := utils.RandomValue(24)
+		assert.Nil(t, db.Put(utils.GetTestKey(i%1000), value))
+		expected[string(utils.GetTestKey(i%1000))] = value
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	checkData := func(db *DB) {
+		stat, err := db.Stat()
+		assert.Nil(t, err)
+		assert.Equal(t, uint(len(expected)), stat.KeyNum)
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+	}
+
+	// merge 写到一半失败，然后崩溃
+	fi.FailWrite(10, syscall.ENOSPC)
+	err := db.Merge()
+	assert.Equal(t, syscall.ENOSPC, err)
+	checkData(db)
+	crashDB(t, db, fi)
+
+	db, fi = openFaultyDB(t, opts)
+	checkData(db)
+	_, err = os.Stat(db.getMergeDirPath())
+	assert.True(t, os.IsNotExist(err))
+
+	// merge 完成之后崩溃，merge 期间的写入也不能丢
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(5000), []byte("after-merge")))
+	assert.Nil(t, db.Sync())
+	expected[string(utils.GetTestKey(5000))] = []byte("after-merge")
+	crashDB(t, db, fi)
+
+	db, _ = openFaultyDB(t, opts)
+	checkData(db)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Less(t, stat.ReclaimableSize, int64(1024))
+	err = db.Close()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,184 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var ErrInjectedFault = errors.New("注入的故障")
+
+// FaultInjector 给一组 IOManager 注入故障，模拟磁盘写满、持久化失败、写入不完整、掉电、数据损坏等情况
+// 写入与持久化的次数在所有包装过的文件上累计，"第 n 次"都是从调用配置方法之后开始数
+type FaultInjector struct {
+	mu     sync.Mutex
+	writes int
+	syncs  int
+	files  []*FaultyFile
+
+	failWriteAt    int
+	writeErr       error
+	shortWriteAt   int
+	corruptWriteAt int
+	failSyncAt     int
+	syncErr        error
+}
+
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{}
+}
+
+// Wrap 包装 fileName 对应的 IOManager，此时文件中已有的数据视为已经持久化
+func (fi *FaultInjector) Wrap(fileName string, ioManager IOManager) IOManager {
+	size, _ := ioManager.Size()
+	f := &FaultyFile{IOManager: ioManager, injector: fi, fileName: fileName, synced: size}
+	fi.mu.Lock()
+	fi.files = append(fi.files, f)
+	fi.mu.Unlock()
+	return f
+}
+
+// FailWrite 第 n 次写入不写任何数据，直接返回 err（比如 syscall.ENOSPC），err 为 nil 时返回 ErrInjectedFault
+func (fi *FaultInjector) FailWrite(n int, err error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.failWriteAt = fi.writes + n
+	fi.writeErr = err
+}
+
+// ShortWrite 第 n 次写入只写一半，返回 io.ErrShortWrite
+func (fi *FaultInjector) ShortWrite(n int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.shortWriteAt = fi.writes + n
+}
+
+// CorruptWrite 第 n 次写入时把中间的一个字节改掉，写入本身是成功的
+func (fi *FaultInjector) CorruptWrite(n int) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.corruptWriteAt = fi.writes + n
+}
+
+// FailSync 第 n 次持久化失败，返回 err，err 为 nil 时返回 ErrInjectedFault
+func (fi *FaultInjector) FailSync(n int, err error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.failSyncAt = fi.syncs + n
+	fi.syncErr = err
+}
+
+// Crash 模拟掉电：每个文件都丢掉最近一次持久化之后写入的数据，关闭时没有持久化的文件也一样
+func (fi *FaultInjector) Crash() error {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	for _, f := range fi.files {
+		if !f.closed {
+			if err := f.IOManager.Truncate(f.synced); err != nil {
+				return err
+			}
+			continue
+		}
+		// 已经被删掉的文件不用管
+		info, err := os.Stat(f.fileName)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Size() > f.synced {
+			if err := os.Truncate(f.fileName, f.synced); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// FaultyFile 被 FaultInjector 包装的 IOManager
+type FaultyFile struct {
+	IOManager
+	injector *FaultInjector
+	fileName string
+	synced   int64 // 最近一次持久化时的文件大小
+	closed   bool
+}
+
+func (f *FaultyFile) Write(b []byte) (int, error) {
+	fi := f.injector
+	fi.mu.Lock()
+	fi.writes++
+	n, writeErr := fi.writes, fi.writeErr
+	failWrite, shortWrite, corruptWrite := n == fi.failWriteAt, n == fi.shortWriteAt, n == fi.corruptWriteAt
+	fi.mu.Unlock()
+
+	switch {
+	case failWrite:
+		if writeErr != nil {
+			return 0, writeErr
+		}
+		return 0, ErrInjectedFault
+	case shortWrite:
+		written, err := f.IOManager.Write(b[:len(b)/2])
+		if err != nil {
+			return written, err
+		}
+		return written, io.ErrShortWrite
+	case corruptWrite:
+		corrupted := append([]byte(nil), b...)
+		if len(corrupted) > 0 {
+			corrupted[len(corrupted)/2] ^= 0xff
+		}
+		return f.IOManager.Write(corrupted)
+	}
+	return f.IOManager.Write(b)
+}
+
+func (f *FaultyFile) Sync() error {
+	fi := f.injector
+	fi.mu.Lock()
+	fi.syncs++
+	failSync, syncErr := fi.syncs == fi.failSyncAt, fi.syncErr
+	fi.mu.Unlock()
+
+	if failSync {
+		if syncErr != nil {
+			return syncErr
+		}
+		return ErrInjectedFault
+	}
+	if err := f.IOManager.Sync(); err != nil {
+		return err
+	}
+	size, err := f.IOManager.Size()
+	if err != nil {
+		return err
+	}
+	fi.mu.Lock()
+	f.synced = size
+	fi.mu.Unlock()
+	return nil
+}
+
+func (f *FaultyFile) Truncate(size int64) error {
+	if err := f.IOManager.Truncate(size); err != nil {
+		return err
+	}
+	fi := f.injector
+	fi.mu.Lock()
+	if f.synced > size {
+		f.synced = size
+	}
+	fi.mu.Unlock()
+	return nil
+}
+
+func (f *FaultyFile) Close() error {
+	fi := f.injector
+	fi.mu.Lock()
+	f.closed = true
+	fi.mu.Unlock()
+	return f.IOManager.Close()
+}
@@ -0,0 +1,64 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultInjector(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fault")
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "fault.data")
+	fileIO, err := NewFileIOManager(fileName)
+	assert.Nil(t, err)
+
+	fi := NewFaultInjector()
+	f := fi.Wrap(fileName, fileIO)
+
+	fi.FailWrite(2, syscall.ENOSPC)
+	_, err = f.Write([]byte("0123"))
+	assert.Nil(t, err)
+	n, err := f.Write([]byte("4567"))
+	assert.Equal(t, syscall.ENOSPC, err)
+	assert.Equal(t, 0, n)
+	size, _ := f.Size()
+	assert.Equal(t, int64(4), size)
+
+	fi.ShortWrite(1)
+	n, err = f.Write([]byte("4567"))
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, 2, n)
+	assert.Nil(t, f.Truncate(4))
+
+	fi.CorruptWrite(1)
+	_, err = f.Write([]byte("4567"))
+	assert.Nil(t, err)
+	b := make([]byte, 4)
+	_, err = f.Read(b, 4)
+	assert.Nil(t, err)
+	assert.NotEqual(t, []byte("4567"), b)
+
+	fi.FailSync(1, nil)
+	assert.Equal(t, ErrInjectedFault, f.Sync())
+
+	// 持久化之后写入的数据在掉电时丢失
+	assert.Nil(t, f.Sync())
+	_, err = f.Write([]byte("89"))
+	assert.Nil(t, err)
+	assert.Nil(t, fi.Crash())
+	size, _ = f.Size()
+	assert.Equal(t, int64(8), size)
+
+	// 关闭之前没有持久化
+	_, err = f.Write([]byte("89"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	assert.Nil(t, fi.Crash())
+	info, _ := os.Stat(fileName)
+	assert.Equal(t, int64(8), info.Size())
+}
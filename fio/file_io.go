@@ -43,6 +43,11 @@ func (fio *FileIO) Close() error {
 	return fio.fd.Close()
 }
 
+// Truncate
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
+
 // Size
 func (fio *FileIO) Size() (int64, error) {
 	f, err := fio.fd.Stat()
@@ -7,6 +7,8 @@ type FileIOType = byte
 const (
 	StandardFile FileIOType = iota
 	MemoryMap
+	WritableMemoryMap // 可读可写的内存映射，用于活跃文件
+	InMemory          // 数据只在内存中，不对应任何文件
 )
 
 // IOManager 抽象 IO 管理接口，可接入不同类型的 IO
@@ -26,6 +28,9 @@ type IOManager interface {
 
 	// Size 文件大小
 	Size() (int64, error)
+
+	// Truncate 截断文件至指定大小
+	Truncate(int64) error
 }
 
 func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
@@ -35,6 +40,11 @@ func NewIOManager(fileName string, ioType FileIOType) (IOManager, error) {
 		return NewFileIOManager(fileName)
 	case MemoryMap:
 		return NewMMapIOManager(fileName)
+	case WritableMemoryMap:
+		// 不预分配，按需扩大
+		return NewWritableMMapIOManager(fileName, 0)
+	case InMemory:
+		return NewMemoryIOManager(), nil
 	default:
 		panic("暂不支持此文件类型")
 	}
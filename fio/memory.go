@@ -0,0 +1,65 @@
+package fio
+
+import (
+	"io"
+	"sync"
+)
+
+// MemoryFile 数据只保存在内存中的 IOManager，关闭之后数据就没有了
+type MemoryFile struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemoryIOManager() *MemoryFile {
+	return &MemoryFile{}
+}
+
+func (mf *MemoryFile) Read(b []byte, offset int64) (int, error) {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	if offset >= int64(len(mf.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mf.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mf *MemoryFile) Write(b []byte) (int, error) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.data = append(mf.data, b...)
+	return len(b), nil
+}
+
+// Sync 没有需要持久化的数据
+func (mf *MemoryFile) Sync() error {
+	return nil
+}
+
+func (mf *MemoryFile) Close() error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.data = nil
+	return nil
+}
+
+func (mf *MemoryFile) Size() (int64, error) {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	return int64(len(mf.data)), nil
+}
+
+func (mf *MemoryFile) Truncate(size int64) error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if size <= int64(len(mf.data)) {
+		mf.data = mf.data[:size]
+		return nil
+	}
+	mf.data = append(mf.data, make([]byte, size-int64(len(mf.data)))...)
+	return nil
+}
@@ -0,0 +1,41 @@
+package fio
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryFile(t *testing.T) {
+	mf, err := NewIOManager("ignored", InMemory)
+	assert.Nil(t, err)
+
+	_, err = mf.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = mf.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	size, _ := mf.Size()
+	assert.Equal(t, int64(10), size)
+
+	b := make([]byte, 5)
+	n, err := mf.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-b"), b)
+	n, err = mf.Read(b, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, n)
+
+	assert.Nil(t, mf.Truncate(5))
+	_, err = mf.Read(b, 5)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, mf.Truncate(8))
+	size, _ = mf.Size()
+	assert.Equal(t, int64(8), size)
+
+	assert.Nil(t, mf.Sync())
+	assert.Nil(t, mf.Close())
+	size, _ = mf.Size()
+	assert.Equal(t, int64(0), size)
+}
@@ -28,6 +28,10 @@ func (mm *MMap) Sync() error {
 	panic("暂无此功能")
 }
 
+func (mm *MMap) Truncate(int64) error {
+	panic("暂无此功能")
+}
+
 func (mm *MMap) Close() error {
 	return mm.readerAt.Close()
 }
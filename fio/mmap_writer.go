@@ -0,0 +1,147 @@
+//go:build unix
+
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// WritableMMap 可写的内存映射，用于活跃文件
+// 打开时把文件扩展到预分配的大小并整体映射，写入就是内存拷贝，持久化时调用 msync，
+// 关闭时把文件截断到实际写入的长度
+type WritableMMap struct {
+	mu     sync.RWMutex
+	fd     *os.File
+	data   []byte // 映射的内存，长度即预分配的大小
+	offset int64  // 实际写入的长度
+}
+
+// NewWritableMMapIOManager capacity 为预分配的大小，写满之后会自动扩大
+func NewWritableMMapIOManager(fileName string, capacity int64) (*WritableMMap, error) {
+	fd, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	mm := &WritableMMap{fd: fd, offset: info.Size()}
+	if err := mm.remap(max(capacity, info.Size(), int64(os.Getpagesize()))); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return mm, nil
+}
+
+// remap 把文件扩展到 size 并重新映射
+func (mm *WritableMMap) remap(size int64) error {
+	if mm.data != nil {
+		if err := unix.Munmap(mm.data); err != nil {
+			return err
+		}
+		mm.data = nil
+	}
+	if err := mm.fd.Truncate(size); err != nil {
+		return err
+	}
+	data, err := unix.Mmap(int(mm.fd.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	mm.data = data
+	return nil
+}
+
+func (mm *WritableMMap) Read(b []byte, offset int64) (int, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	// 已经关闭，映射的内存解除了
+	if mm.data == nil {
+		return 0, os.ErrClosed
+	}
+	if offset >= mm.offset {
+		return 0, io.EOF
+	}
+	n := copy(b, mm.data[offset:mm.offset])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mm *WritableMMap) Write(b []byte) (int, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.data == nil {
+		return 0, os.ErrClosed
+	}
+	// 单条数据超过预分配的大小时才会走到这里
+	if need := mm.offset + int64(len(b)); need > int64(len(mm.data)) {
+		if err := mm.remap(max(need, 2*int64(len(mm.data)))); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(mm.data[mm.offset:], b)
+	mm.offset += int64(n)
+	return n, nil
+}
+
+func (mm *WritableMMap) Sync() error {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	if mm.data == nil {
+		return os.ErrClosed
+	}
+	// 还没有写入（比如刚封存换了新的活跃文件），长度为 0 的 msync 会返回 EINVAL
+	if mm.offset == 0 {
+		return nil
+	}
+	return unix.Msync(mm.data[:mm.offset], unix.MS_SYNC)
+}
+
+// Truncate 只改变实际写入的长度，截掉的部分清零，避免崩溃后被当成数据读出来
+func (mm *WritableMMap) Truncate(size int64) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if size > int64(len(mm.data)) {
+		if err := mm.remap(size); err != nil {
+			return err
+		}
+	}
+	if size < mm.offset {
+		clear(mm.data[size:mm.offset])
+	}
+	mm.offset = size
+	return nil
+}
+
+func (mm *WritableMMap) Size() (int64, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	return mm.offset, nil
+}
+
+// Close 持久化后解除映射，并去掉预分配但没有用到的空间
+func (mm *WritableMMap) Close() error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if err := unix.Msync(mm.data, unix.MS_SYNC); err != nil {
+		return err
+	}
+	if err := unix.Munmap(mm.data); err != nil {
+		return err
+	}
+	mm.data = nil
+	if err := mm.fd.Truncate(mm.offset); err != nil {
+		_ = mm.fd.Close()
+		return err
+	}
+	return mm.fd.Close()
+}
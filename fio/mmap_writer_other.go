@@ -0,0 +1,16 @@
+//go:build !unix
+
+package fio
+
+import "errors"
+
+var errWritableMMapUnsupported = errors.New("当前系统不支持可写的内存映射")
+
+// WritableMMap 可写的内存映射，只在类 Unix 系统上可用
+type WritableMMap struct {
+	IOManager
+}
+
+func NewWritableMMapIOManager(fileName string, capacity int64) (*WritableMMap, error) {
+	return nil, errWritableMMapUnsupported
+}
@@ -0,0 +1,91 @@
+//go:build unix
+
+package fio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritableMMap(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-writer")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mmap-writer.data")
+
+	mm, err := NewWritableMMapIOManager(path, 8192)
+	assert.Nil(t, err)
+	n, err := mm.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	_, err = mm.Write([]byte("key-b"))
+	assert.Nil(t, err)
+
+	// 文件已经预分配，但是只能读到写入的部分
+	info, _ := os.Stat(path)
+	assert.Equal(t, int64(8192), info.Size())
+	size, _ := mm.Size()
+	assert.Equal(t, int64(10), size)
+	b := make([]byte, 5)
+	_, err = mm.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+	_, err = mm.Read(b, 10)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, mm.Sync())
+
+	// 截断后的部分清零
+	assert.Nil(t, mm.Truncate(5))
+	_, err = mm.Read(b, 5)
+	assert.Equal(t, io.EOF, err)
+
+	// 超过预分配的大小时自动扩大
+	big := make([]byte, 9000)
+	big[8999] = 'x'
+	_, err = mm.Write(big)
+	assert.Nil(t, err)
+	_, err = mm.Read(b, 9000)
+	assert.Nil(t, err)
+	assert.Equal(t, byte('x'), b[4])
+
+	// 关闭时截断到实际写入的长度
+	assert.Nil(t, mm.Close())
+	info, _ = os.Stat(path)
+	assert.Equal(t, int64(9005), info.Size())
+
+	mm2, err := NewWritableMMapIOManager(path, 0)
+	assert.Nil(t, err)
+	size, _ = mm2.Size()
+	assert.Equal(t, int64(9005), size)
+	_, err = mm2.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	assert.Nil(t, mm2.Close())
+}
+
+func TestWritableMMap_SyncEmpty(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-mmap-writer-sync")
+	defer os.RemoveAll(dir)
+
+	// 刚创建还没有写入的文件也能持久化
+	mm, err := NewWritableMMapIOManager(filepath.Join(dir, "mmap-writer.data"), 8192)
+	assert.Nil(t, err)
+	assert.Nil(t, mm.Sync())
+	_, err = mm.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	assert.Nil(t, mm.Sync())
+	assert.Nil(t, mm.Truncate(0))
+	assert.Nil(t, mm.Sync())
+	assert.Nil(t, mm.Close())
+
+	// 关闭之后映射已经解除，不能再读写
+	b := make([]byte, 5)
+	_, err = mm.Read(b, 0)
+	assert.Equal(t, os.ErrClosed, err)
+	_, err = mm.Write([]byte("key-b"))
+	assert.Equal(t, os.ErrClosed, err)
+	assert.Equal(t, os.ErrClosed, mm.Sync())
+}
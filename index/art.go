@@ -11,6 +11,8 @@ import (
 
 // AdaptiveRadixTree 自适应基数树索引
 // 封装了 github.com/plar/go-adaptive-radix-tree 库
+// 库不支持快照和反向遍历，迭代器和快照不是惰性的：创建时在读锁下按顺序把所有元素复制出来，O(N)
+// 写入不需要为它们做任何事情
 type AdaptiveRadixTree struct {
 	tree goart.Tree
 	lock *sync.RWMutex
@@ -24,11 +26,12 @@ func NewART() *AdaptiveRadixTree {
 	}
 }
 
-func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) bool {
+func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	art.lock.Lock()
-	art.tree.Insert(key, pos)
+	oldValue, _ := art.tree.Insert(key, pos)
 	art.lock.Unlock()
-	return true
+	oldPos, _ := oldValue.(*data.LogRecordPos)
+	return oldPos
 }
 
 // Get 根据 key 取出对应的索引位置信息
@@ -43,11 +46,12 @@ func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
 }
 
 // Delete 根据 key 删除对应的索引位置信息
-func (art *AdaptiveRadixTree) Delete(key []byte) bool {
+func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
-	_, deleted := art.tree.Delete(key)
+	oldValue, deleted := art.tree.Delete(key)
 	art.lock.Unlock()
-	return deleted
+	oldPos, _ := oldValue.(*data.LogRecordPos)
+	return oldPos, deleted
 }
 
 // Size 索引中的数据量
@@ -62,58 +66,84 @@ func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
 
-// Iterator 索引迭代器
+// Snapshot 复制出当前所有元素，O(N)
+func (art *AdaptiveRadixTree) Snapshot() Reader {
+	return &artSnapshot{items: art.items()}
+}
+
+// Iterator 索引迭代器，创建时复制出当前所有元素，之后的写入对它不可见
 func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
+	return newArtIterator(art.items(), reverse)
+}
+
+// items 按 key 从小到大取出所有元素
+func (art *AdaptiveRadixTree) items() []*Item {
 	art.lock.RLock()
-	iterator := newArtIterator(art.tree, reverse)
-	art.lock.RUnlock()
-	return iterator
+	defer art.lock.RUnlock()
+	items := make([]*Item, 0, art.tree.Size())
+	art.tree.ForEach(func(node goart.Node) bool {
+		items = append(items, &Item{key: node.Key(), pos: node.Value().(*data.LogRecordPos)})
+		return true
+	})
+	return items
+}
+
+// artSnapshot ART 索引的只读视图，元素不会再被修改，迭代器直接共用
+type artSnapshot struct {
+	items []*Item
+}
+
+func (s *artSnapshot) Get(key []byte) *data.LogRecordPos {
+	i := sort.Search(len(s.items), func(i int) bool {
+		return bytes.Compare(s.items[i].key, key) >= 0
+	})
+	if i < len(s.items) && bytes.Equal(s.items[i].key, key) {
+		return s.items[i].pos
+	}
+	return nil
+}
+
+func (s *artSnapshot) Iterator(reverse bool) Iterator {
+	return newArtIterator(s.items, reverse)
+}
+
+func (s *artSnapshot) Size() int {
+	return len(s.items)
+}
+
+func (s *artSnapshot) Close() error {
+	s.items = nil
+	return nil
 }
 
 // ART 索引迭代器
+// 元素按 key 从小到大保存，反向遍历时下标从后往前走
 type artIterator struct {
 	currIndex int     // 当前遍历的下标位置
 	reverse   bool    // 是否是反向遍历
 	values    []*Item // key+位置索引信息
 }
 
-func newArtIterator(tree goart.Tree, reverse bool) *artIterator {
-	var idx int
-	if reverse {
-		idx = tree.Size() - 1
-	}
-	values := make([]*Item, tree.Size())
-	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
-		}
-		values[idx] = item
-		if reverse {
-			idx--
-		} else {
-			idx++
-		}
-		return true
-	}
-
-	tree.ForEach(saveValues)
-	return &artIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
-	}
+func newArtIterator(values []*Item, reverse bool) *artIterator {
+	ai := &artIterator{reverse: reverse, values: values}
+	ai.Rewind()
+	return ai
 }
 
 func (ai *artIterator) Rewind() {
-	ai.currIndex = 0
+	if ai.reverse {
+		ai.currIndex = len(ai.values) - 1
+	} else {
+		ai.currIndex = 0
+	}
 }
 
+// Seek 二分查找
 func (ai *artIterator) Seek(key []byte) {
 	if ai.reverse {
 		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) <= 0
-		})
+			return bytes.Compare(ai.values[i].key, key) > 0
+		}) - 1
 	} else {
 		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
 			return bytes.Compare(ai.values[i].key, key) >= 0
@@ -122,11 +152,15 @@ func (ai *artIterator) Seek(key []byte) {
 }
 
 func (ai *artIterator) Next() {
-	ai.currIndex += 1
+	if ai.reverse {
+		ai.currIndex--
+	} else {
+		ai.currIndex++
+	}
 }
 
 func (ai *artIterator) Valid() bool {
-	return ai.currIndex < len(ai.values)
+	return ai.currIndex >= 0 && ai.currIndex < len(ai.values)
 }
 
 func (ai *artIterator) Key() []byte {
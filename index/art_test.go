@@ -2,7 +2,11 @@ package index
 
 import (
 	"bitcask/data"
+	"math/rand"
+	"sort"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestAdaptiveRadixTree_Put(t *testing.T) {
@@ -31,7 +35,7 @@ func TestAdaptiveRadixTree_Delete(t *testing.T) {
 	art.Put([]byte("eeda"), &data.LogRecordPos{Fid: 11, Offset: 123})
 	art.Put([]byte("bbue"), &data.LogRecordPos{Fid: 11, Offset: 123})
 
-	b := art.Delete([]byte("e1eda"))
+	_, b := art.Delete([]byte("e1eda"))
 	t.Log(b)
 }
 
@@ -45,3 +49,88 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 
 	art.Iterator(true)
 }
+
+func TestAdaptiveRadixTree_IteratorSnapshot(t *testing.T) {
+	testIteratorSnapshot(t, NewART())
+}
+
+func TestAdaptiveRadixTree_IteratorOrder(t *testing.T) {
+	art := NewART()
+	r := rand.New(rand.NewSource(1))
+	expected := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		// 前缀重叠得多，也有互为前缀的 key
+		key := make([]byte, r.Intn(6))
+		for j := range key {
+			key[j] = "abc\x00\xff"[r.Intn(5)]
+		}
+		art.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		expected[string(key)] = true
+	}
+	keys := make([]string, 0, len(expected))
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, len(keys), art.Size())
+
+	collect := func(iter Iterator) []string {
+		var result []string
+		for ; iter.Valid(); iter.Next() {
+			result = append(result, string(iter.Key()))
+		}
+		iter.Close()
+		return result
+	}
+	assert.Equal(t, keys, collect(art.Iterator(false)))
+
+	reversed := make([]string, len(keys))
+	for i, key := range keys {
+		reversed[len(keys)-1-i] = key
+	}
+	assert.Equal(t, reversed, collect(art.Iterator(true)))
+
+	for _, seek := range []string{"", "b", "ab\x00", "c\xff\xff\xff\xff\xff\xff"} {
+		i := sort.SearchStrings(keys, seek)
+		iter := art.Iterator(false)
+		iter.Seek([]byte(seek))
+		assert.Equal(t, keys[i:], collect(iter))
+
+		j := sort.Search(len(reversed), func(k int) bool { return reversed[k] <= seek })
+		iter = art.Iterator(true)
+		iter.Seek([]byte(seek))
+		assert.Equal(t, reversed[j:], collect(iter))
+	}
+}
+
+func TestAdaptiveRadixTree_Snapshot(t *testing.T) {
+	art := NewART()
+	art.Put([]byte("a"), &data.LogRecordPos{Fid: 1})
+	art.Put([]byte("b"), &data.LogRecordPos{Fid: 1})
+
+	snapshot := art.Snapshot()
+	art.Put([]byte("a"), &data.LogRecordPos{Fid: 2})
+	art.Delete([]byte("b"))
+	art.Put([]byte("c"), &data.LogRecordPos{Fid: 2})
+
+	assert.Equal(t, &data.LogRecordPos{Fid: 1}, snapshot.Get([]byte("a")))
+	assert.Equal(t, &data.LogRecordPos{Fid: 1}, snapshot.Get([]byte("b")))
+	assert.Nil(t, snapshot.Get([]byte("c")))
+	assert.Equal(t, 2, snapshot.Size())
+	iter := snapshot.Iterator(false)
+	var keys []string
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	iter.Close()
+	assert.Nil(t, snapshot.Close())
+
+	art.Put([]byte("d"), &data.LogRecordPos{Fid: 2})
+	art.Put([]byte("e"), &data.LogRecordPos{Fid: 2})
+	art.Put([]byte("f"), &data.LogRecordPos{Fid: 2})
+	assert.Equal(t, 5, art.Size())
+	assert.Equal(t, &data.LogRecordPos{Fid: 2}, art.Get([]byte("a")))
+	assert.Nil(t, art.Get([]byte("b")))
+}
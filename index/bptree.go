@@ -2,14 +2,21 @@ package index
 
 import (
 	"bitcask/data"
+	"bytes"
 	"path/filepath"
 
 	"go.etcd.io/bbolt"
 )
 
-const indexFileName = "bptree-index"
+// BPTreeIndexFileName B+树索引落盘的文件名
+const BPTreeIndexFileName = "bptree-index"
 
-var indexBucketName = []byte("bitcask-index")
+var (
+	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta")
+	// 索引中的位置信息都带有数据长度
+	posSizeKey = []byte("pos-size")
+)
 
 // BPlusTree B+树索引，将索引存储到磁盘上
 // 使用 etcd 的 bbolt 库
@@ -22,29 +29,44 @@ func NewBPlusTree(dirPath string, sync bool) *BPlusTree {
 	// 打开 bbolt 实例
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !sync
-	bptree, err := bbolt.Open(filepath.Join(dirPath, indexFileName), 0644, opts)
+	opts.InitialMmapSize = bptreeInitialMmapSize
+	bptree, err := bbolt.Open(filepath.Join(dirPath, BPTreeIndexFileName), 0644, opts)
 	if err != nil {
 		panic("failed to open bptree at startup")
 	}
 
 	// 创建一个对应的 bucket
 	if err := bptree.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
-		return err
+		meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(indexBucketName) != nil {
+			return nil
+		}
+		// 新建的索引不需要迁移
+		if _, err := tx.CreateBucket(indexBucketName); err != nil {
+			return err
+		}
+		return meta.Put(posSizeKey, []byte{1})
 	}); err != nil {
 		panic("failed to create bptree bucket at startup")
 	}
 	return &BPlusTree{tree: bptree}
 }
 
-func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) bool {
+func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
+		if oldValue := bucket.Get(key); len(oldValue) != 0 {
+			oldPos = data.DecodeLogRecordPos(oldValue)
+		}
 		return bucket.Put(key, data.EncodeLogRecordPos(pos))
 	}); err != nil {
 		panic("failed to put index in bptree")
 	}
-	return true
+	return oldPos
 }
 
 func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
@@ -62,14 +84,19 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 	return pos
 }
 
-func (bpt *BPlusTree) Delete(key []byte) bool {
+func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
-		return bucket.Delete(key)
+		if oldValue := bucket.Get(key); len(oldValue) != 0 {
+			oldPos = data.DecodeLogRecordPos(oldValue)
+			return bucket.Delete(key)
+		}
+		return nil
 	}); err != nil {
 		panic("failed to delete index in bptree")
 	}
-	return true
+	return oldPos, oldPos != nil
 }
 
 func (bpt *BPlusTree) Size() int {
@@ -84,31 +111,105 @@ func (bpt *BPlusTree) Size() int {
 	return size
 }
 
+// MigratePosSize 为旧版本索引中没有数据长度的位置信息补上长度，只会执行一次
+// readSize 根据位置信息从数据文件中读出数据编码后的长度
+func (bpt *BPlusTree) MigratePosSize(readSize func(pos *data.LogRecordPos) (uint32, error)) error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucketName)
+		if len(meta.Get(posSizeKey)) != 0 {
+			return nil
+		}
+
+		// 遍历过程中不能修改 bucket，先记下来
+		bucket := tx.Bucket(indexBucketName)
+		var keys [][]byte
+		var values [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			pos := data.DecodeLogRecordPos(v)
+			if pos.Size != 0 {
+				return nil
+			}
+			size, err := readSize(pos)
+			if err != nil {
+				return err
+			}
+			pos.Size = size
+			keys = append(keys, append([]byte(nil), k...))
+			values = append(values, data.EncodeLogRecordPos(pos))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for i := range keys {
+			if err := bucket.Put(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		return meta.Put(posSizeKey, []byte{1})
+	})
+}
+
 func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
-	return newBptreeIterator(bpt.tree, reverse)
+	tx, err := bpt.tree.Begin(false)
+	if err != nil {
+		panic("failed to begin a transaction")
+	}
+	return newBptreeIterator(tx, reverse, true)
+}
+
+// Snapshot 用一个只读事务固定住当前的索引
+// 只读事务没结束之前，超出 bptreeInitialMmapSize 的扩容会被阻塞，快照要及时关闭
+func (bpt *BPlusTree) Snapshot() Reader {
+	tx, err := bpt.tree.Begin(false)
+	if err != nil {
+		panic("failed to begin a transaction")
+	}
+	return &bptreeSnapshot{tx: tx}
+}
+
+// bptreeSnapshot B+树索引的只读视图
+type bptreeSnapshot struct {
+	tx *bbolt.Tx
+}
+
+func (bs *bptreeSnapshot) Get(key []byte) *data.LogRecordPos {
+	value := bs.tx.Bucket(indexBucketName).Get(key)
+	if len(value) == 0 {
+		return nil
+	}
+	return data.DecodeLogRecordPos(value)
+}
+
+func (bs *bptreeSnapshot) Iterator(reverse bool) Iterator {
+	return newBptreeIterator(bs.tx, reverse, false)
+}
+
+func (bs *bptreeSnapshot) Size() int {
+	return bs.tx.Bucket(indexBucketName).Stats().KeyN
+}
+
+func (bs *bptreeSnapshot) Close() error {
+	return bs.tx.Rollback()
 }
 
 // B+树迭代器
 type bptreeIterator struct {
 	tx        *bbolt.Tx
+	ownTx     bool // 事务是否由迭代器自己创建，是的话关闭时结束事务
 	cursor    *bbolt.Cursor
 	reverse   bool
 	currKey   []byte
 	currValue []byte
 }
 
-func newBptreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
-	tx, err := tree.Begin(false)
-	if err != nil {
-		panic("failed to begin a transaction")
-	}
-
+func newBptreeIterator(tx *bbolt.Tx, reverse bool, ownTx bool) *bptreeIterator {
 	bi := &bptreeIterator{
 		tx:      tx,
+		ownTx:   ownTx,
 		cursor:  tx.Bucket(indexBucketName).Cursor(),
 		reverse: reverse,
 	}
@@ -126,6 +227,14 @@ func (bi *bptreeIterator) Rewind() {
 
 func (bi *bptreeIterator) Seek(key []byte) {
 	bi.currKey, bi.currValue = bi.cursor.Seek(key)
+	// 反向遍历时找的是首个小于等于 key 的位置
+	if bi.reverse {
+		if bi.currKey == nil {
+			bi.currKey, bi.currValue = bi.cursor.Last()
+		} else if bytes.Compare(bi.currKey, key) > 0 {
+			bi.currKey, bi.currValue = bi.cursor.Prev()
+		}
+	}
 }
 
 func (bi *bptreeIterator) Next() {
@@ -149,5 +258,7 @@ func (bi *bptreeIterator) Value() *data.LogRecordPos {
 }
 
 func (bi *bptreeIterator) Close() {
-	_ = bi.tx.Rollback()
+	if bi.ownTx {
+		_ = bi.tx.Rollback()
+	}
 }
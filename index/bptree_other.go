@@ -0,0 +1,6 @@
+//go:build !unix
+
+package index
+
+// bptreeInitialMmapSize windows 下映射多大文件就会被扩到多大，使用 bbolt 的默认值
+const bptreeInitialMmapSize = 0
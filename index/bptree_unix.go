@@ -0,0 +1,8 @@
+//go:build unix
+
+package index
+
+// bptreeInitialMmapSize bbolt 初始映射的大小
+// 快照和迭代器是 bbolt 的只读事务，映射不够大时写入要等它们结束才能扩容，
+// 预先映射足够大的空间，写入就不会被快照阻塞；unix 下只占地址空间，不会让文件变大
+const bptreeInitialMmapSize = 1 << 30
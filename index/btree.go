@@ -3,7 +3,6 @@ package index
 import (
 	"bitcask/data"
 	"bytes"
-	"sort"
 	"sync"
 
 	"github.com/google/btree"
@@ -22,28 +21,33 @@ func NewBtree() *BTree {
 	}
 }
 
-func (b *BTree) Put(key []byte, pos *data.LogRecordPos) bool {
+func (b *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	item := &Item{
 		key: key,
 		pos: pos,
 	}
 	b.lock.Lock()
-	b.tree.ReplaceOrInsert(item)
+	oldItem := b.tree.ReplaceOrInsert(item)
 	b.lock.Unlock()
-	return true
+	if oldItem == nil {
+		return nil
+	}
+	return oldItem.(*Item).pos
 }
 func (b *BTree) Get(key []byte) *data.LogRecordPos {
 	item := &Item{
 		key: key,
 	}
+	b.lock.RLock()
 	bitem := b.tree.Get(item)
+	b.lock.RUnlock()
 	if bitem == nil {
 		return nil
 	}
 
 	return bitem.(*Item).pos
 }
-func (b *BTree) Delete(key []byte) bool {
+func (b *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	item := &Item{
 		key: key,
 	}
@@ -51,24 +55,38 @@ func (b *BTree) Delete(key []byte) bool {
 	bitem := b.tree.Delete(item)
 	b.lock.Unlock()
 
-	// if bitem == nil {
-	// 	return false
-	// }
-	// return true
-
-	return bitem != nil
+	if bitem == nil {
+		return nil, false
+	}
+	return bitem.(*Item).pos, true
 }
 
+// Iterator 索引迭代器，遍历的是写时复制的副本，之后的写入对它不可见
 func (b *BTree) Iterator(reverse bool) Iterator {
 	if b.tree == nil {
 		return nil
 	}
-	b.lock.RLock()
-	defer b.lock.RUnlock()
-	return newBtreeIterator(b.tree, reverse)
+	// Clone 会修改原来的树，不能和其他操作并发
+	b.lock.Lock()
+	tree := b.tree.Clone()
+	b.lock.Unlock()
+	return newBtreeIterator(tree, reverse)
+}
+
+// Snapshot 写时复制的副本，O(1)
+func (b *BTree) Snapshot() Reader {
+	b.lock.Lock()
+	tree := b.tree.Clone()
+	b.lock.Unlock()
+	return &BTree{
+		tree: tree,
+		lock: new(sync.RWMutex),
+	}
 }
 
 func (b *BTree) Size() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 	return b.tree.Len()
 }
 
@@ -76,57 +94,41 @@ func (b *BTree) Close() error {
 	return nil
 }
 
-// Btree 索引迭代器
+// 迭代器每次从树上取出的元素个数
+const btreeIteratorBatch = 64
+
+// Btree 索引迭代器，每次只从副本上取出一小批元素
 type btreeIterator struct {
-	currIndex int     // 当前位置
-	reverse   bool    // 反向遍历与否
-	values    []*Item // b树元素集
+	tree      *btree.BTree // 创建迭代器时的副本
+	reverse   bool         // 反向遍历与否
+	currIndex int          // 在当前这批元素中的位置
+	values    []*Item      // 当前这批元素
 }
 
 // newBtreeIterator 构建Btree迭代器，以容纳索引迭代器Iterator接口操作
 func newBtreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	// 主要任务是给btreeIterator.values添加正序或倒序的B树元素 -> Descend()&Ascend()
-
-	var index int
-	values := make([]*Item, tree.Len())
-
-	saveValues := func(it btree.Item) bool {
-		values[index] = it.(*Item)
-		index++
-		return true // 配合Descend()&Ascend()，必须返回true
-	}
-
-	if reverse {
-		tree.Descend(saveValues)
-	} else {
-		tree.Ascend(saveValues)
-	}
-
-	return &btreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+	bi := &btreeIterator{
+		tree:    tree,
+		reverse: reverse,
 	}
+	bi.Rewind()
+	return bi
 }
 
 func (bi *btreeIterator) Rewind() {
-	bi.currIndex = 0
+	bi.load(nil, true)
 }
 
 func (bi *btreeIterator) Seek(key []byte) {
-	if bi.reverse {
-		bi.currIndex = sort.Search(len(bi.values), func(i int) bool {
-			return bytes.Compare(bi.values[i].key, key) <= 0
-		})
-	} else {
-		bi.currIndex = sort.Search(len(bi.values), func(i int) bool {
-			return bytes.Compare(bi.values[i].key, key) >= 0
-		})
-	}
+	bi.load(&Item{key: key}, true)
 }
 
 func (bi *btreeIterator) Next() {
 	bi.currIndex++
+	// 上一批取满了说明后面可能还有，从最后一个元素之后接着取
+	if bi.currIndex == len(bi.values) && len(bi.values) == btreeIteratorBatch {
+		bi.load(bi.values[len(bi.values)-1], false)
+	}
 }
 
 func (bi *btreeIterator) Valid() bool {
@@ -142,5 +144,32 @@ func (bi *btreeIterator) Value() *data.LogRecordPos {
 }
 
 func (bi *btreeIterator) Close() {
+	bi.tree = nil
 	bi.values = nil
 }
+
+// load 从 pivot 开始按遍历方向取出一批元素，pivot 为 nil 时从头开始，inclusive 为 false 时不包括 pivot 本身
+func (bi *btreeIterator) load(pivot *Item, inclusive bool) {
+	values := bi.values[:0]
+	saveValues := func(it btree.Item) bool {
+		item := it.(*Item)
+		if !inclusive && bytes.Equal(item.key, pivot.key) {
+			return true
+		}
+		values = append(values, item)
+		return len(values) < btreeIteratorBatch
+	}
+
+	switch {
+	case pivot == nil && bi.reverse:
+		bi.tree.Descend(saveValues)
+	case pivot == nil:
+		bi.tree.Ascend(saveValues)
+	case bi.reverse:
+		bi.tree.DescendLessOrEqual(pivot, saveValues)
+	default:
+		bi.tree.AscendGreaterOrEqual(pivot, saveValues)
+	}
+	bi.currIndex = 0
+	bi.values = values
+}
@@ -2,6 +2,7 @@ package index
 
 import (
 	"bitcask/data"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -17,17 +18,22 @@ func TestBTree_Put(t *testing.T) {
 	// 边界情况检测
 
 	res1 := btree.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
-	assert.True(t, res1)
+	assert.Nil(t, res1)
 
 	res2 := btree.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 10})
-	assert.True(t, res2)
+	assert.Nil(t, res2)
+
+	// 覆盖已有的key，返回旧的位置信息
+	res3 := btree.Put([]byte("a"), &data.LogRecordPos{Fid: 11, Offset: 12})
+	assert.Equal(t, uint32(1), res3.Fid)
+	assert.Equal(t, int64(10), res3.Offset)
 }
 
 func TestBTree_Get(t *testing.T) {
 	btree := NewBtree()
 
 	res1 := btree.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
-	assert.True(t, res1)
+	assert.Nil(t, res1)
 
 	// 能存nil？
 	pos1 := btree.Get(nil)
@@ -35,10 +41,10 @@ func TestBTree_Get(t *testing.T) {
 	assert.Equal(t, int64(100), pos1.Offset)
 
 	res2 := btree.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 10})
-	assert.True(t, res2)
+	assert.Nil(t, res2)
 
 	res3 := btree.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 100})
-	assert.True(t, res3)
+	assert.NotNil(t, res3)
 
 	pos2 := btree.Get([]byte("a"))
 	assert.Equal(t, uint32(1), pos2.Fid)
@@ -49,10 +55,16 @@ func TestBTree_Delete(t *testing.T) {
 	btree := NewBtree()
 
 	res1 := btree.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
-	assert.True(t, res1)
+	assert.Nil(t, res1)
+
+	res2, ok := btree.Delete(nil)
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), res2.Offset)
 
-	res2 := btree.Delete(nil)
-	assert.True(t, res2)
+	// 删除不存在的key
+	res3, ok := btree.Delete([]byte("unknown"))
+	assert.False(t, ok)
+	assert.Nil(t, res3)
 }
 
 func TestBTree_Iterator(t *testing.T) {
@@ -96,3 +108,45 @@ func TestBTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+// testIteratorSnapshot 迭代器跨越多批元素遍历，并且看不到创建之后的写入
+func testIteratorSnapshot(t *testing.T, index Indexer) {
+	for i := 0; i < 1000; i++ {
+		index.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter1 := index.Iterator(false)
+	iter2 := index.Iterator(true)
+	for i := 0; i < 1000; i += 2 {
+		index.Delete([]byte(fmt.Sprintf("key-%04d", i)))
+		index.Put([]byte(fmt.Sprintf("key-%04d-new", i)), &data.LogRecordPos{Fid: 2})
+	}
+	index.Put([]byte("key-0001"), &data.LogRecordPos{Fid: 3})
+
+	var count int
+	for iter1.Rewind(); iter1.Valid(); iter1.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%04d", count)), iter1.Key())
+		assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: int64(count)}, iter1.Value())
+		count++
+	}
+	assert.Equal(t, 1000, count)
+
+	for iter2.Seek([]byte("key-0500x")); iter2.Valid(); iter2.Next() {
+		count--
+	}
+	assert.Equal(t, 499, count)
+	iter1.Close()
+	iter2.Close()
+
+	// 新的迭代器能看到所有写入
+	iter3 := index.Iterator(false)
+	count = 0
+	for iter3.Seek([]byte("key-0990")); iter3.Valid(); iter3.Next() {
+		count++
+	}
+	assert.Equal(t, 10, count)
+	iter3.Close()
+}
+
+func TestBTree_IteratorSnapshot(t *testing.T) {
+	testIteratorSnapshot(t, NewBtree())
+}
@@ -8,14 +8,27 @@ import (
 )
 
 type Indexer interface {
-	Put(key []byte, pos *data.LogRecordPos) bool
+	// Put 存入索引，返回被覆盖掉的旧位置信息，没有则返回 nil
+	Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
 	Get(key []byte) *data.LogRecordPos
-	Delete(key []byte) bool
+	// Delete 删除索引，返回被删掉的位置信息以及删除成功与否
+	Delete(key []byte) (*data.LogRecordPos, bool)
 	Iterator(reverse bool) Iterator
 
 	// Size 索引中的数据量
 	Size() int
 	Close() error // 专门给BPTree准备的
+
+	// Snapshot 取当前索引的只读视图，之后的写入对它不可见，用完要 Close
+	Snapshot() Reader
+}
+
+// Reader 索引在某一时刻的只读视图
+type Reader interface {
+	Get(key []byte) *data.LogRecordPos
+	Iterator(reverse bool) Iterator
+	Size() int
+	Close() error
 }
 
 type Item struct {
@@ -8,39 +8,86 @@ import (
 type Iterator struct {
 	indexIterator index.Iterator
 	db            *DB
+	snapshot      *Snapshot // 快照上的迭代器从快照固定住的数据文件中读取
 	options       IteratorOptions
+	count         int // 从起点开始已经遍历过的key数量，用于 Limit
+
+	// 实际的遍历范围 [lowerBound, upperBound)，由 LowerBound、UpperBound 和 Prefix 一起决定
+	lowerBound []byte
+	upperBound []byte
 }
 
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
-	indexIter := db.index.Iterator(opts.Reverse)
-	return &Iterator{
+	return newIterator(db, nil, db.index.Iterator(opts.Reverse), opts)
+}
+
+func newIterator(db *DB, snapshot *Snapshot, indexIter index.Iterator, opts IteratorOptions) *Iterator {
+	iterator := &Iterator{
 		indexIterator: indexIter,
 		db:            db,
+		snapshot:      snapshot,
 		options:       opts,
+		lowerBound:    opts.LowerBound,
+		upperBound:    opts.UpperBound,
 	}
+	// 有前缀的key都在 [Prefix, prefixUpperBound(Prefix)) 范围内，直接收窄范围
+	if len(opts.Prefix) > 0 {
+		if bytes.Compare(opts.Prefix, iterator.lowerBound) > 0 {
+			iterator.lowerBound = opts.Prefix
+		}
+		upper := prefixUpperBound(opts.Prefix)
+		if upper != nil && (len(iterator.upperBound) == 0 || bytes.Compare(upper, iterator.upperBound) < 0) {
+			iterator.upperBound = upper
+		}
+	}
+	iterator.Rewind()
+	return iterator
 }
 
-// Rewind 回到迭代器起点，即第一个数据
+// Rewind 回到迭代器起点，即范围内的第一个数据
 func (i *Iterator) Rewind() {
-	i.indexIterator.Rewind()
+	i.count = 0
+	switch {
+	case !i.options.Reverse && len(i.lowerBound) > 0:
+		i.indexIterator.Seek(i.lowerBound)
+	case i.options.Reverse && len(i.upperBound) > 0:
+		i.seekBeforeUpperBound()
+	default:
+		i.indexIterator.Rewind()
+	}
 	i.skipToNext()
 }
 
-// Seek 查找首个大于（小于）等于key，并据此key开始遍历
+// Seek 查找首个大于（小于）等于key，并据此key开始遍历，key超出范围时从范围的起点开始
 func (i *Iterator) Seek(key []byte) {
-	i.indexIterator.Seek(key)
+	i.count = 0
+	switch {
+	case !i.options.Reverse && len(i.lowerBound) > 0 && bytes.Compare(key, i.lowerBound) < 0:
+		i.indexIterator.Seek(i.lowerBound)
+	case i.options.Reverse && len(i.upperBound) > 0 && bytes.Compare(key, i.upperBound) >= 0:
+		i.seekBeforeUpperBound()
+	default:
+		i.indexIterator.Seek(key)
+	}
 	i.skipToNext()
 }
 
 // Next 跳转到下一个key
 func (i *Iterator) Next() {
 	i.indexIterator.Next()
+	i.count++
 	i.skipToNext()
 }
 
-// Valid 有效性检验，用于退出遍历
+// Valid 有效性检验，用于退出遍历，超出范围或者达到 Limit 之后都无效
 func (i *Iterator) Valid() bool {
-	return i.indexIterator.Valid()
+	if i.options.Limit > 0 && i.count >= i.options.Limit {
+		return false
+	}
+	if !i.indexIterator.Valid() {
+		return false
+	}
+	return i.inBounds(i.indexIterator.Key())
 }
 
 // Key 当前key值
@@ -50,9 +97,15 @@ func (i *Iterator) Key() []byte {
 
 // Value 当前value值
 func (i *Iterator) Value() ([]byte, error) {
+	if i.options.KeysOnly {
+		return nil, ErrKeysOnly
+	}
 	pos := i.indexIterator.Value()
 	i.db.mu.RLock()
 	defer i.db.mu.RUnlock()
+	if i.snapshot != nil {
+		return i.snapshot.getValue(pos)
+	}
 	return i.db.getValueByPostion(pos)
 }
 
@@ -61,16 +114,46 @@ func (i *Iterator) Close() {
 	i.indexIterator.Close()
 }
 
-func (i *Iterator) skipToNext() {
-	prefixlen := len(i.options.Prefix)
-	if prefixlen == 0 {
-		return
+// seekBeforeUpperBound 反向遍历时定位到首个小于 UpperBound 的key
+func (i *Iterator) seekBeforeUpperBound() {
+	i.indexIterator.Seek(i.upperBound)
+	if i.indexIterator.Valid() && bytes.Equal(i.indexIterator.Key(), i.upperBound) {
+		i.indexIterator.Next()
 	}
+}
+
+// inBounds key 是否在 [LowerBound, UpperBound) 范围内
+func (i *Iterator) inBounds(key []byte) bool {
+	if len(i.lowerBound) > 0 && bytes.Compare(key, i.lowerBound) < 0 {
+		return false
+	}
+	if len(i.upperBound) > 0 && bytes.Compare(key, i.upperBound) >= 0 {
+		return false
+	}
+	return true
+}
 
+// skipToNext 跳过已过期的key，走出范围时停下
+func (i *Iterator) skipToNext() {
 	for ; i.indexIterator.Valid(); i.indexIterator.Next() {
-		key := i.indexIterator.Key()
-		if prefixlen <= len(key) && bytes.Equal(i.options.Prefix, key[:prefixlen]) {
+		if !i.inBounds(i.indexIterator.Key()) {
 			break
 		}
+		if !isExpired(i.indexIterator.Value().Expire) {
+			break
+		}
+	}
+}
+
+// prefixUpperBound 大于所有以 prefix 开头的key的最小key，prefix 全是 0xff 时没有上界，返回 nil
+func prefixUpperBound(prefix []byte) []byte {
+	for n := len(prefix) - 1; n >= 0; n-- {
+		if prefix[n] != 0xff {
+			upper := make([]byte, n+1)
+			copy(upper, prefix)
+			upper[n]++
+			return upper
+		}
 	}
+	return nil
 }
@@ -1,7 +1,9 @@
 package bitcask_go
 
 import (
+	"bitcask/index"
 	"bitcask/utils"
+	"fmt"
 	"os"
 	"testing"
 
@@ -97,3 +99,194 @@ func TestDB_Iterator_Multi_Values(t *testing.T) {
 	}
 	iter3.Close()
 }
+
+func TestDB_Iterator_Bounds(t *testing.T) {
+	for _, indexType := range []IndexType{Btree, ART, BPlusTree} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-iterator-bounds")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for _, key := range []string{"a", "b", "c", "d", "e"} {
+			err = db.Put([]byte(key), []byte("val-"+key))
+			assert.Nil(t, err)
+		}
+
+		collect := func(iterOpts IteratorOptions, seek []byte) string {
+			iter := db.NewIterator(iterOpts)
+			defer iter.Close()
+			var keys string
+			if seek != nil {
+				iter.Seek(seek)
+			}
+			for ; iter.Valid(); iter.Next() {
+				keys += string(iter.Key())
+			}
+			return keys
+		}
+
+		iterOpts := DefaultIteratorOptions
+		iterOpts.LowerBound = []byte("b")
+		iterOpts.UpperBound = []byte("d")
+		assert.Equal(t, "bc", collect(iterOpts, nil))
+		assert.Equal(t, "bc", collect(iterOpts, []byte("a")))
+		assert.Equal(t, "c", collect(iterOpts, []byte("bb")))
+		assert.Equal(t, "", collect(iterOpts, []byte("d")))
+
+		// 反向遍历同样是 [LowerBound, UpperBound)
+		iterOpts.Reverse = true
+		assert.Equal(t, "cb", collect(iterOpts, nil))
+		assert.Equal(t, "cb", collect(iterOpts, []byte("z")))
+		assert.Equal(t, "b", collect(iterOpts, []byte("bb")))
+		assert.Equal(t, "", collect(iterOpts, []byte("a")))
+
+		// 边界不在数据中
+		iterOpts = DefaultIteratorOptions
+		iterOpts.LowerBound = []byte("bb")
+		iterOpts.UpperBound = []byte("dd")
+		assert.Equal(t, "cd", collect(iterOpts, nil))
+		iterOpts.Reverse = true
+		assert.Equal(t, "dc", collect(iterOpts, nil))
+
+		// 只有一侧边界
+		iterOpts = DefaultIteratorOptions
+		iterOpts.UpperBound = []byte("c")
+		assert.Equal(t, "ab", collect(iterOpts, nil))
+		iterOpts.Reverse = true
+		assert.Equal(t, "ba", collect(iterOpts, nil))
+		iterOpts = DefaultIteratorOptions
+		iterOpts.LowerBound = []byte("d")
+		iterOpts.Reverse = true
+		assert.Equal(t, "ed", collect(iterOpts, nil))
+
+		// Limit，Rewind 和 Seek 之后重新计数
+		iterOpts = DefaultIteratorOptions
+		iterOpts.Limit = 2
+		assert.Equal(t, "ab", collect(iterOpts, nil))
+		assert.Equal(t, "cd", collect(iterOpts, []byte("c")))
+		iterOpts.Reverse = true
+		iterOpts.UpperBound = []byte("e")
+		assert.Equal(t, "dc", collect(iterOpts, nil))
+
+		// KeysOnly 不读取 value
+		iterOpts = DefaultIteratorOptions
+		iterOpts.KeysOnly = true
+		iter := db.NewIterator(iterOpts)
+		assert.True(t, iter.Valid())
+		assert.Equal(t, []byte("a"), iter.Key())
+		_, err = iter.Value()
+		assert.Equal(t, ErrKeysOnly, err)
+		iter.Close()
+
+		iter = db.NewIterator(DefaultIteratorOptions)
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("val-a"), val)
+		iter.Close()
+
+		destroyDB(db)
+	}
+}
+
+// countingIterator 记录索引迭代器上 Next 的调用次数
+type countingIterator struct {
+	index.Iterator
+	nexts int
+}
+
+func (ci *countingIterator) Next() {
+	ci.nexts++
+	ci.Iterator.Next()
+}
+
+func TestDB_Iterator_PrefixSeek(t *testing.T) {
+	for _, indexType := range []IndexType{Btree, ART, BPlusTree} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-iterator-prefix")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for i := 0; i < 100; i++ {
+			for _, prefix := range []string{"a:", "b:", "c:"} {
+				err = db.Put([]byte(fmt.Sprintf("%s%03d", prefix, i)), utils.RandomValue(10))
+				assert.Nil(t, err)
+			}
+		}
+		for _, key := range [][]byte{{0xff}, {0xff, 0xff}, {0xff, 0xff, 0x01}} {
+			err = db.Put(key, utils.RandomValue(10))
+			assert.Nil(t, err)
+		}
+
+		collect := func(iterOpts IteratorOptions) ([]string, int) {
+			iter := db.NewIterator(iterOpts)
+			defer iter.Close()
+			counter := &countingIterator{Iterator: iter.indexIterator}
+			iter.indexIterator = counter
+			var keys []string
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				keys = append(keys, string(iter.Key()))
+			}
+			return keys, counter.nexts
+		}
+
+		// 直接定位到前缀，离开前缀之后不再往下走
+		iterOpts := DefaultIteratorOptions
+		iterOpts.Prefix = []byte("b:")
+		keys, nexts := collect(iterOpts)
+		assert.Equal(t, 100, len(keys))
+		assert.Equal(t, "b:000", keys[0])
+		assert.Equal(t, "b:099", keys[99])
+		assert.Equal(t, 100, nexts)
+
+		iterOpts.Reverse = true
+		keys, nexts = collect(iterOpts)
+		assert.Equal(t, 100, len(keys))
+		assert.Equal(t, "b:099", keys[0])
+		assert.Equal(t, "b:000", keys[99])
+		assert.Equal(t, 100, nexts)
+
+		// 前缀和范围同时生效
+		iterOpts = DefaultIteratorOptions
+		iterOpts.Prefix = []byte("c:")
+		iterOpts.LowerBound = []byte("c:090")
+		iterOpts.UpperBound = []byte("d")
+		keys, _ = collect(iterOpts)
+		assert.Equal(t, 10, len(keys))
+		iterOpts.Reverse = true
+		iterOpts.UpperBound = []byte("c:095")
+		keys, _ = collect(iterOpts)
+		assert.Equal(t, []string{"c:094", "c:093", "c:092", "c:091", "c:090"}, keys)
+
+		// 前缀全是 0xff 时没有上界
+		iterOpts = DefaultIteratorOptions
+		iterOpts.Prefix = []byte{0xff, 0xff}
+		keys, _ = collect(iterOpts)
+		assert.Equal(t, []string{"\xff\xff", "\xff\xff\x01"}, keys)
+		iterOpts.Reverse = true
+		keys, _ = collect(iterOpts)
+		assert.Equal(t, []string{"\xff\xff\x01", "\xff\xff"}, keys)
+
+		// 没有匹配的前缀
+		iterOpts = DefaultIteratorOptions
+		iterOpts.Prefix = []byte("bb")
+		keys, nexts = collect(iterOpts)
+		assert.Empty(t, keys)
+		assert.Equal(t, 0, nexts)
+
+		destroyDB(db)
+	}
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	assert.Equal(t, []byte("b"), prefixUpperBound([]byte("a")))
+	assert.Equal(t, []byte("ac"), prefixUpperBound([]byte("ab")))
+	assert.Equal(t, []byte{'b'}, prefixUpperBound([]byte{'a', 0xff, 0xff}))
+	assert.Nil(t, prefixUpperBound([]byte{0xff, 0xff}))
+	assert.Nil(t, prefixUpperBound(nil))
+}
@@ -0,0 +1,182 @@
+package bitcask_go
+
+import (
+	"bitcask/cache"
+	"bitcask/data"
+	"bitcask/index"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// openInMemory 内存模式不碰文件系统：没有数据目录、文件锁、merge 目录与序列号文件，
+// 数据文件都是 fio.InMemory，关闭之后数据就没有了
+func openInMemory(options Options, codec *data.Codec) (*DB, error) {
+	// B+树索引要落盘，改用内存中的 B 树
+	if options.IndexType == BPlusTree {
+		options.IndexType = Btree
+	}
+	options.IOType = StandardFileIO
+	options.MMapStartup = false
+
+	db := &DB{
+		mu:         new(sync.RWMutex),
+		olderFiles: make(map[uint32]*data.DataFile),
+		options:    options,
+		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrite),
+		codec:      codec,
+		isInitial:  true,
+		closeCh:    make(chan struct{}),
+	}
+	if options.CacheSize > 0 {
+		db.cache = cache.NewLRU(options.CacheSize)
+	}
+
+	if db.options.MergeCheckInterval > 0 {
+		db.autoMergeWg.Add(1)
+		go db.autoMerge()
+	}
+	return db, nil
+}
+
+// mergeInMemory 内存模式没有下次启动，merge 直接在当前实例上生效：
+// 把旧文件中仍然有效的数据重新写到活跃文件，再丢掉旧文件
+// 数据都写到了新的位置，旧位置不会被复用，读缓存不受影响
+func (db *DB) mergeInMemory() error {
+	db.mu.Lock()
+	if db.activeFile == nil {
+		db.mu.Unlock()
+		return nil
+	}
+	if db.isMerging {
+		db.mu.Unlock()
+		return ErrMergeInProgress
+	}
+	db.isMerging = true
+	// 后台的自动 merge 也会读写这个标志，同样要加锁
+	defer func() {
+		db.mu.Lock()
+		db.isMerging = false
+		db.mu.Unlock()
+	}()
+
+	if err := db.rotateActiveFile(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	var mergeFiles []*data.DataFile
+	for _, file := range db.olderFiles {
+		mergeFiles = append(mergeFiles, file)
+	}
+	db.mu.Unlock()
+
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].FileId < mergeFiles[j].FileId
+	})
+
+	// 旧文件中除了有效数据以外都可以回收
+	var reclaimed int64
+	for _, dataFile := range mergeFiles {
+		fileSize, err := dataFile.IOManager.Size()
+		if err != nil {
+			return err
+		}
+		reclaimed += fileSize
+
+		// 旧文件不会再被修改，不加锁读取
+		var keys [][]byte
+		var logRecords []*data.LogRecord
+		var oldPositions []*data.LogRecordPos
+		var offset int64 = 0
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			realKey, _ := parseLogRecordKey(logRecord.Key)
+			if pos := db.index.Get(realKey); pos != nil && pos.Fid == dataFile.FileId && pos.Offset == offset {
+				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+				keys = append(keys, realKey)
+				logRecords = append(logRecords, logRecord)
+				oldPositions = append(oldPositions, pos)
+			}
+			offset += size
+		}
+
+		if err := db.rewriteLiveRecords(keys, logRecords, oldPositions, &reclaimed); err != nil {
+			return err
+		}
+	}
+
+	db.mu.Lock()
+	// 不关闭旧文件，正在读它的协程还能读完，之后随垃圾回收释放
+	for _, dataFile := range mergeFiles {
+		delete(db.olderFiles, dataFile.FileId)
+	}
+	db.mu.Unlock()
+
+	atomic.AddInt64(&db.reclaimSize, -reclaimed)
+	return nil
+}
+
+// rewriteLiveRecords 把一个旧文件中的有效数据写到活跃文件并更新索引
+// 读取期间可能有新的写入覆盖了其中的 key，加锁之后只重写索引仍然指向旧位置的数据
+func (db *DB) rewriteLiveRecords(keys [][]byte, logRecords []*data.LogRecord,
+	oldPositions []*data.LogRecordPos, reclaimed *int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var liveKeys [][]byte
+	var liveRecords []*data.LogRecord
+	for i, key := range keys {
+		pos := db.index.Get(key)
+		if pos == nil || pos.Fid != oldPositions[i].Fid || pos.Offset != oldPositions[i].Offset {
+			continue
+		}
+		// 没有计入可回收量，不管是否过期都要减掉
+		*reclaimed -= int64(pos.Size)
+		// 过期数据直接丢掉
+		if isExpired(pos.Expire) {
+			db.index.Delete(key)
+			continue
+		}
+		liveKeys = append(liveKeys, key)
+		liveRecords = append(liveRecords, logRecords[i])
+	}
+	if len(liveRecords) == 0 {
+		return nil
+	}
+
+	positions, err := db.writeLogRecords(liveRecords)
+	if err != nil {
+		return err
+	}
+	for i, key := range liveKeys {
+		db.index.Put(key, positions[i])
+	}
+	return nil
+}
+
+// memorySize 内存模式下所有数据文件占用的字节数，调用方需要持有 db.mu
+func (db *DB) memorySize() (int64, error) {
+	var size int64
+	for _, dataFile := range db.olderFiles {
+		fileSize, err := dataFile.IOManager.Size()
+		if err != nil {
+			return 0, err
+		}
+		size += fileSize
+	}
+	if db.activeFile != nil {
+		fileSize, err := db.activeFile.IOManager.Size()
+		if err != nil {
+			return 0, err
+		}
+		size += fileSize
+	}
+	return size, nil
+}
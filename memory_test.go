@@ -0,0 +1,93 @@
+package bitcask_go
+
+import (
+	"bitcask/utils"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_InMemory(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath = ""
+	opts.InMemory = true
+	opts.DataFileSize = 32 * 1024
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new-value"))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.PutWithTTL(utils.GetTestKey(1000), []byte("ttl"), 100*time.Millisecond)
+	assert.Nil(t, err)
+
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 2000; i < 2100; i++ {
+		err := wb.Put(utils.GetTestKey(i), []byte("batch"))
+		assert.Nil(t, err)
+	}
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1001), stat.KeyNum)
+	assert.Greater(t, stat.ReclaimableSize, int64(0))
+	sizeBefore := stat.DiskSize
+
+	// 等带 TTL 的 key 过期，merge 时会丢掉它
+	assert.Eventually(t, func() bool {
+		_, err := db.Get(utils.GetTestKey(1000))
+		return err == ErrKeyNotFound
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// merge 立即生效，占用的内存变少，数据不变
+	err = db.Merge()
+	assert.Nil(t, err)
+	stat, err = db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1000), stat.KeyNum)
+	assert.Less(t, stat.DiskSize, sizeBefore/2)
+	assert.Less(t, stat.ReclaimableSize, int64(1024))
+
+	for i := 0; i < 100; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for i := 100; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new-value"), val)
+	}
+	_, err = db.Get(utils.GetTestKey(1000))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	iter := db.NewIterator(IteratorOptions{Prefix: []byte("bitcask-go-0000020")})
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("batch"), val)
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 100, count)
+
+	err = db.Backup(os.TempDir())
+	assert.Equal(t, ErrInMemory, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
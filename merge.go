@@ -8,6 +8,8 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -29,28 +31,32 @@ func (db *DB) Merge() error {
 	// 通过索引，把每一个文件中的数据重新写入新的mergeFile中，然后增加hint索引文件
 	// 最后尾部添加“完成文件”来标识这一系列merge已完成
 
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	if db.options.InMemory {
+		return db.mergeInMemory()
+	}
+	db.mu.Lock()
 	if db.activeFile == nil {
+		db.mu.Unlock()
 		return nil
 	}
-	db.mu.Lock()
 	if db.isMerging {
 		db.mu.Unlock()
 		return ErrMergeInProgress
 	}
 
 	db.isMerging = true
+	// 后台的自动 merge 也会读写这个标志，同样要加锁
 	defer func() {
+		db.mu.Lock()
 		db.isMerging = false
+		db.mu.Unlock()
 	}()
 
-	if err := db.activeFile.Sync(); err != nil {
-		db.mu.Unlock()
-		return err
-	}
 	nonMergeFileId := db.activeFile.FileId + 1
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-
-	if err := db.setActiveFile(); err != nil {
+	if err := db.rotateActiveFile(); err != nil {
 		db.mu.Unlock()
 		return err
 	}
@@ -81,15 +87,22 @@ func (db *DB) Merge() error {
 	mergeOpts := db.options
 	mergeOpts.SyncWrite = false
 	mergeOpts.DirPath = mergePath
+	mergeOpts.MergeCheckInterval = 0
+	// merge 只顺序读写一遍数据，不需要缓存
+	mergeOpts.CacheSize = 0
 	mergeDB, err := Open(mergeOpts)
 	if err != nil {
 		return err
 	}
+	defer mergeDB.Close()
 
 	hintFile, err := data.OpenHintFile(mergeDB.options.DirPath)
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
+	// hint 文件里有 key，同样需要加密
+	hintFile.Codec = db.codec
 
 	for _, dataFile := range mergeFiles {
 		var offset int64 = 0
@@ -105,15 +118,22 @@ func (db *DB) Merge() error {
 			realKey, _ := parseLogRecordKey(logRecord.Key)
 			logRecordPos := db.index.Get(realKey)
 
+			// 过期数据直接丢掉，不再占用磁盘
 			if logRecordPos != nil &&
 				logRecordPos.Fid == dataFile.FileId &&
-				logRecordPos.Offset == offset {
+				logRecordPos.Offset == offset &&
+				!isExpired(logRecord.Expire) {
 				// 写入数据
 				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
 				pos, err := mergeDB.appendLogRecord(logRecord)
 				if err != nil {
 					return err
 				}
+				// 换了密钥、压缩方式之后数据可能变大，merge 的结果只能用 nonMergeFileId 之前的编号，
+				// 否则生效时会覆盖掉 merge 期间写入的数据文件
+				if pos.Fid >= nonMergeFileId {
+					return ErrMergeTooLarge
+				}
 				// 录入索引
 				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
 					return err
@@ -132,10 +152,22 @@ func (db *DB) Merge() error {
 	}
 
 	// 标识完成
-	mergeFinFile, err := data.OpenMergeFinishedFile(mergeDB.options.DirPath)
+	if err := writeMergeFinishedFile(mergeDB.options.DirPath, nonMergeFileId); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.mergePending = true
+	db.mu.Unlock()
+	return nil
+}
+
+// writeMergeFinishedFile 写入 merge 完成标识，id 小于 nonMergeFileId 的数据文件都已经被 hint 文件覆盖
+func writeMergeFinishedFile(dirPath string, nonMergeFileId uint32) error {
+	mergeFinFile, err := data.OpenMergeFinishedFile(dirPath)
 	if err != nil {
 		return err
 	}
+	defer mergeFinFile.Close()
 	mergeFinRecord := &data.LogRecord{
 		Key:   []byte(mergeFinishedKey),
 		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
@@ -144,10 +176,42 @@ func (db *DB) Merge() error {
 	if err := mergeFinFile.Write(encRecord); err != nil {
 		return err
 	}
-	if err := mergeFinFile.Sync(); err != nil {
-		return err
+	return mergeFinFile.Sync()
+}
+
+// autoMerge 后台定期检查可回收数据的占比，超过 MergeRatio 就执行 merge
+func (db *DB) autoMerge() {
+	defer db.autoMergeWg.Done()
+
+	ticker := time.NewTicker(db.options.MergeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+			if !db.reachMergeRatio() {
+				continue
+			}
+			// 别处正在 merge 时跳过，出错了就等下次再试
+			_ = db.Merge()
+		}
 	}
-	return nil
+}
+
+// reachMergeRatio 可回收数据占磁盘空间的比例是否达到阈值
+// 上次 merge 的结果还没生效（要等重启）时，可回收量还没减掉，再 merge 也只是重写同一批数据，不算达到
+func (db *DB) reachMergeRatio() bool {
+	db.mu.RLock()
+	pending := db.mergePending
+	diskSize, err := db.diskSize()
+	db.mu.RUnlock()
+	if pending || err != nil || diskSize == 0 {
+		return false
+	}
+	reclaimSize := atomic.LoadInt64(&db.reclaimSize)
+	return float32(reclaimSize)/float32(diskSize) >= db.options.MergeRatio
 }
 
 func (db *DB) getMergeDirPath() string {
@@ -158,10 +222,15 @@ func (db *DB) getMergeDirPath() string {
 
 // 在启动数据库时调用，此函数负责将临时merge目录内的所有文件移动到原始目录下
 func (db *DB) loadMergeFiles() error {
+	// 只读模式不动目录里的文件，还没生效的 merge 结果留给写进程处理
+	if db.options.ReadOnly {
+		return nil
+	}
 	mergePath := db.getMergeDirPath()
 	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
 		return nil
 	}
+
 	defer func() {
 		_ = os.RemoveAll(mergePath)
 	}()
@@ -193,13 +262,17 @@ func (db *DB) loadMergeFiles() error {
 		return err
 	}
 
-	// 移除原始目录下的旧数据文件
+	// 移除原始目录下的旧数据文件及其 hint
 	var fileId uint32 = 0
 	for ; fileId < nonMergeFileId; fileId++ {
-		fileName := data.GetDataFileName(db.options.DirPath, fileId)
-		if _, err := os.Stat(fileName); err == nil {
-			if err := os.Remove(fileName); err != nil {
-				return err
+		for _, fileName := range []string{
+			data.GetDataFileName(db.options.DirPath, fileId),
+			data.GetFileHintName(db.options.DirPath, fileId),
+		} {
+			if _, err := os.Stat(fileName); err == nil {
+				if err := os.Remove(fileName); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -212,6 +285,7 @@ func (db *DB) loadMergeFiles() error {
 		}
 	}
 
+	db.mergeLoaded = true
 	return nil
 }
 
@@ -224,7 +298,11 @@ func (db *DB) loadIndexFromHintFile() error {
 	if err != nil {
 		return err
 	}
+	defer hintFile.Close()
+	hintFile.Codec = db.codec
 
+	var records []*data.HintRecord
+	var migrated bool
 	var offset int64 = 0
 	for {
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
@@ -236,10 +314,27 @@ func (db *DB) loadIndexFromHintFile() error {
 		}
 
 		logRecordPos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, logRecordPos)
+		// 旧版本写的 hint 没有记录数据长度，读一遍数据文件补上
+		if logRecordPos.Size == 0 {
+			if logRecordPos.Size, err = db.readRecordSize(logRecordPos); err != nil {
+				return err
+			}
+			migrated = true
+		}
+		records = append(records, &data.HintRecord{Key: logRecord.Key, Type: logRecord.Type, Pos: logRecordPos})
+		if !isExpired(logRecordPos.Expire) {
+			if oldPos := db.index.Put(logRecord.Key, logRecordPos); oldPos != nil {
+				db.reclaimSize += int64(oldPos.Size)
+			}
+		}
 
 		offset += size
 	}
+
+	// 补上长度之后重写 hint，下次启动就不用再读数据文件了
+	if migrated && !db.options.ReadOnly {
+		return data.RewriteHintFile(db.options.DirPath, records, db.codec)
+	}
 	return nil
 }
 
@@ -0,0 +1,237 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024 * 1024
+	opts.MergeRatio = 0.4
+	opts.MergeCheckInterval = 20 * time.Millisecond
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer os.RemoveAll(db.getMergeDirPath())
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	// 可回收的数据还不多，不会触发 merge
+	time.Sleep(100 * time.Millisecond)
+	_, err = os.Stat(db.getMergeDirPath())
+	assert.True(t, os.IsNotExist(err))
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	mergeFinFile := filepath.Join(db.getMergeDirPath(), data.MergeFinishedFileName)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(mergeFinFile)
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// merge 结果生效之前不会再对同一批数据 merge
+	info, err := os.Stat(mergeFinFile)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	info2, err := os.Stat(mergeFinFile)
+	assert.Nil(t, err)
+	assert.Equal(t, info.ModTime(), info2.ModTime())
+
+	// Close 会等待后台 merge 退出，重启后 merge 结果生效
+	err = db.Close()
+	assert.Nil(t, err)
+	stat, _ := db.Stat()
+
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 40000, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(10001))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	stat2, err := db2.Stat()
+	assert.Nil(t, err)
+	assert.Less(t, stat2.DiskSize, stat.DiskSize)
+}
+
+func TestDB_Merge_Concurrent(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-concurrent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	defer os.RemoveAll(db.getMergeDirPath())
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+
+	// 同时只有一个 merge 在执行，其他的返回 ErrMergeInProgress
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := db.Merge(); err != nil {
+					assert.Equal(t, ErrMergeInProgress, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, db.Merge())
+}
+
+func TestDB_Merge_Encryption(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-encryption")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 400; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 加密之后每条数据都变大，merge 的结果用到了 merge 期间写入的数据文件的编号
+	opts.EncryptionKey = bytes.Repeat([]byte("a"), 32)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Equal(t, ErrMergeTooLarge, err)
+	for i := 400; i < 450; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 450; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 覆盖写之后有足够的空间，merge 成功，之后的写入在重启之后都还在
+	for i := 0; i < 450; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	for i := 450; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	// merge 之后数据文件里没有明文
+	for _, dataFile := range db.olderFiles {
+		content, err := os.ReadFile(data.GetDataFileName(dir, dataFile.FileId))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(content, utils.GetTestKey(10)))
+	}
+}
+
+func TestDB_Merge_BPlusTree(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-bptree")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	defer os.RemoveAll(db.getMergeDirPath())
+
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 200; i++ {
+			err := db.Put(utils.GetTestKey(i), []byte(fmt.Sprintf("value-%d-%d", i, n)))
+			assert.Nil(t, err)
+		}
+	}
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	// merge 期间之后写入的数据
+	err = db.Put(utils.GetTestKey(1), []byte("after-merge"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 重启后 merge 生效，B+树索引要跟着换成新文件中的位置
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, 199, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after-merge"), val)
+	for i := 2; i < 200; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("value-%d-2", i)), val)
+	}
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// 再次重启直接使用重建好的 B+树索引
+	db3, err := Open(opts)
+	defer destroyDB(db3)
+	assert.Nil(t, err)
+	val, err = db3.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value-100-2"), val)
+	err = db3.Put(utils.GetTestKey(100), []byte("new"))
+	assert.Nil(t, err)
+	val, err = db3.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+}
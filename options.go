@@ -1,6 +1,12 @@
 package bitcask_go
 
-import "os"
+import (
+	"bitcask/data"
+	"bitcask/fio"
+	"os"
+	"runtime"
+	"time"
+)
 
 type Options struct {
 	DirPath      string // 数据目录
@@ -9,13 +15,83 @@ type Options struct {
 	BytesPerSync int       // 持久化数据阈值
 	IndexType    IndexType // 所采用的索引类型
 	MMapStartup  bool      // 使用内存文件映射与否
+
+	// 后台自动 merge：每隔 MergeCheckInterval 检查一次，
+	// 可回收的数据量占磁盘空间的比例达到 MergeRatio 时执行 merge
+	// MergeCheckInterval 为 0 表示不自动 merge
+	MergeRatio         float32
+	MergeCheckInterval time.Duration
+
+	// 写入时 value 所用的压缩算法，读取时按每条数据自身的标志解压，
+	// 所以可以随时更换，merge 时会用新的算法重写所有数据
+	Compression CompressionType
+
+	// 不为空时以 AES-GCM 加密写入的数据与 merge 生成的 hint 文件，长度为 16、24 或 32 字节
+	// 轮换密钥时把旧密钥放到 PreviousEncryptionKeys 中，旧数据仍可读取，
+	// merge 之后所有数据都会用新密钥重新加密，旧密钥就可以去掉了
+	// 注意 B+树索引文件中的 key 不会加密
+	EncryptionKey          []byte
+	PreviousEncryptionKeys [][]byte
+
+	// 启动时并行解析数据文件的协程数，小于等于 0 时使用 CPU 核数
+	LoadIndexWorkers int
+
+	// 启动时用封存文件的 hint 之前，是否对整个数据文件做一次 crc 校验
+	// 默认只核对数据文件的大小，hint 自身的每条记录都有 crc；打开时要多读一遍所有数据文件
+	VerifyFileHints bool
+
+	// 只读打开，在文件锁上加共享锁，多个只读进程可以同时打开同一个目录，但不能和写进程同时打开
+	// 只读模式下 B+树索引会改用内存中的 B 树
+	ReadOnly bool
+
+	// 读缓存的字节数，按数据位置缓存读到的 value，为 0 表示不使用缓存
+	CacheSize int64
+
+	// 活跃文件的 IO 方式，默认 StandardFileIO
+	// MMapIO 把活跃文件预分配到 DataFileSize 并映射到内存，写入只是内存拷贝，持久化时 msync，
+	// 关闭或封存时截断到实际写入的长度；进程崩溃时文件尾部会留下空白，下次启动时截掉
+	IOType IOType
+
+	// 数据只保存在内存中，不使用 DirPath，关闭之后数据就没有了，用于测试或临时缓存
+	// B+树索引会改用内存中的 B 树，IOType 与 MMapStartup 不起作用
+	InMemory bool
+
+	// 测试用，打开数据文件之后用它包装 IOManager，比如注入故障
+	ioManagerWrapper func(fileName string, ioManager fio.IOManager) fio.IOManager
 }
 
 type IndexType = int8
 
+// IOType 活跃文件的 IO 方式
+type IOType = fio.FileIOType
+
+const (
+	StandardFileIO = fio.StandardFile
+	MMapIO         = fio.WritableMemoryMap
+)
+
+// CompressionType 压缩算法，其他算法可以通过 data.RegisterCompressor 注册
+type CompressionType = data.CompressionType
+
+const (
+	NoCompression    = data.NoCompression
+	FlateCompression = data.FlateCompression
+	GzipCompression  = data.GzipCompression
+)
+
 type IteratorOptions struct {
 	Prefix  []byte // 遍历前缀为指定的key（？）
 	Reverse bool
+
+	// 遍历范围 [LowerBound, UpperBound)，为空表示不限制
+	LowerBound []byte
+	UpperBound []byte
+
+	// 最多遍历多少个key，0 表示不限制
+	Limit int
+
+	// 只遍历key，不读取value，Value 返回 ErrKeysOnly
+	KeysOnly bool
 }
 
 type WriteBatchOptions struct {
@@ -29,6 +105,7 @@ type WriteBatchOptions struct {
 // 目前所能支持的索引类型
 const (
 	Btree IndexType = iota + 1
+	// ART 的迭代器和快照在创建时复制出全部索引，O(N)
 	ART
 	BPlusTree
 )
@@ -39,6 +116,13 @@ var DefaultDBOptions = Options{
 	SyncWrite:    false,
 	IndexType:    Btree,
 	MMapStartup:  true,
+
+	MergeRatio:         0.5,
+	MergeCheckInterval: 0,
+
+	Compression: NoCompression,
+
+	LoadIndexWorkers: runtime.NumCPU(),
 }
 
 var DefaultIteratorOptions = IteratorOptions{
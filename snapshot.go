@@ -0,0 +1,103 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"bitcask/index"
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot 数据库在某一时刻的只读视图
+// 固定住创建时的索引以及它引用的数据文件，之后的写入和 merge 都不影响快照读到的数据
+// 用完要 Close，还有快照没关闭时数据库的 Close 返回 ErrSnapshotsOpen
+type Snapshot struct {
+	db        *DB
+	index     index.Reader
+	dataFiles map[uint32]*data.DataFile
+	closeOnce sync.Once
+}
+
+// Snapshot 创建快照
+// B+树索引的快照是 bbolt 的只读事务，索引文件超出预先映射的大小之后，扩容要等快照关闭
+func (db *DB) Snapshot() *Snapshot {
+	// 写入在 db.mu 下更新索引，加锁之后拿到的索引和数据文件是一致的
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.snapshot()
+}
+
+// snapshot 创建快照，调用方需要持有 db.mu
+func (db *DB) snapshot() *Snapshot {
+	dataFiles := make(map[uint32]*data.DataFile, len(db.olderFiles)+1)
+	for fid, dataFile := range db.olderFiles {
+		dataFiles[fid] = dataFile
+	}
+	if db.activeFile != nil {
+		dataFiles[db.activeFile.FileId] = db.activeFile
+	}
+
+	atomic.AddInt64(&db.snapshots, 1)
+	return &Snapshot{
+		db:        db,
+		index:     db.index.Snapshot(),
+		dataFiles: dataFiles,
+	}
+}
+
+// Get 读取快照创建时 key 对应的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	logRecordPos := s.index.Get(key)
+	if logRecordPos == nil || isExpired(logRecordPos.Expire) {
+		return nil, ErrKeyNotFound
+	}
+
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return s.getValue(logRecordPos)
+}
+
+// NewIterator 遍历快照中的数据，迭代器要在快照关闭之前关闭
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	return newIterator(s.db, s, s.index.Iterator(opts.Reverse), opts)
+}
+
+// Fold 遍历快照中的所有数据，用户操作返回 false 时退出
+func (s *Snapshot) Fold(f func(key []byte, value []byte) bool) error {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	i := s.index.Iterator(false)
+	defer i.Close()
+	for i.Rewind(); i.Valid(); i.Next() {
+		if isExpired(i.Value().Expire) {
+			continue
+		}
+		value, err := s.getValue(i.Value())
+		if err != nil {
+			return err
+		}
+		if !f(i.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close 关闭快照，释放索引和数据文件，可以重复调用
+func (s *Snapshot) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.index.Close()
+		atomic.AddInt64(&s.db.snapshots, -1)
+	})
+	return err
+}
+
+// getValue 从快照固定住的数据文件中读取 value，调用方需要持有 db.mu
+func (s *Snapshot) getValue(pos *data.LogRecordPos) ([]byte, error) {
+	return s.db.readValue(s.dataFiles[pos.Fid], pos)
+}
@@ -0,0 +1,200 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"bitcask/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	for _, indexType := range []IndexType{Btree, ART, BPlusTree} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+		opts.DirPath = dir
+		opts.DataFileSize = 32 * 1024
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for i := 0; i < 1000; i++ {
+			err = db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		snap := db.Snapshot()
+
+		// 快照之后的覆盖、删除、新增以及 merge 都看不到
+		for i := 0; i < 1000; i++ {
+			if i%2 == 0 {
+				err = db.Delete(utils.GetTestKey(i))
+			} else {
+				err = db.Put(utils.GetTestKey(i), []byte("new"))
+			}
+			assert.Nil(t, err)
+		}
+		err = db.Put(utils.GetTestKey(5000), []byte("new"))
+		assert.Nil(t, err)
+		err = db.Merge()
+		assert.Nil(t, err)
+
+		for _, i := range []int{0, 1, 500, 999} {
+			val, err := snap.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+		_, err = snap.Get(utils.GetTestKey(5000))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		iterOpts := DefaultIteratorOptions
+		iterOpts.Reverse = true
+		iter := snap.NewIterator(iterOpts)
+		count := 999
+		for ; iter.Valid(); iter.Next() {
+			assert.Equal(t, utils.GetTestKey(count), iter.Key())
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(count), val)
+			count--
+		}
+		assert.Equal(t, -1, count)
+		iter.Close()
+
+		count = 0
+		err = snap.Fold(func(key []byte, value []byte) bool {
+			assert.Equal(t, key, value)
+			count++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, count)
+		assert.Nil(t, snap.Close())
+		assert.Nil(t, snap.Close())
+
+		// 数据库本身看到的是最新的数据
+		_, err = db.Get(utils.GetTestKey(0))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+		assert.Equal(t, 501, len(db.ListKeys()))
+
+		destroyDB(db)
+	}
+}
+
+func TestDB_Snapshot_InMemory(t *testing.T) {
+	opts := DefaultDBOptions
+	opts.DirPath = ""
+	opts.InMemory = true
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		err = db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap := db.Snapshot()
+	defer snap.Close()
+	for i := 0; i < 1000; i++ {
+		err = db.Put(utils.GetTestKey(i), []byte("new"))
+		assert.Nil(t, err)
+	}
+
+	// 内存模式的 merge 直接丢掉旧文件，快照仍然能读到
+	err = db.Merge()
+	assert.Nil(t, err)
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1), stat.DataFileNum)
+	for i := 0; i < 1000; i++ {
+		val, err := snap.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_Snapshot_Close(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-close")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+	assert.Nil(t, err)
+	snap := db.Snapshot()
+	txn := db.Begin()
+
+	// 快照或事务没关闭之前，关闭数据库直接返回错误，数据库还能继续用
+	assert.Equal(t, ErrSnapshotsOpen, db.Close())
+	err = db.Put(utils.GetTestKey(2), utils.GetTestKey(2))
+	assert.Nil(t, err)
+	val, err := snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	assert.Nil(t, snap.Close())
+
+	assert.Equal(t, ErrSnapshotsOpen, db.Close())
+	txn.Rollback()
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Snapshot_MergeFiles(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+		_ = os.RemoveAll(dir + mergeDirName)
+	}()
+
+	for i := 0; i < 1000; i++ {
+		err = db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap := db.Snapshot()
+	for i := 0; i < 1000; i++ {
+		err = db.Put(utils.GetTestKey(i), []byte("new"))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 快照没关闭时数据库关不掉，也就不会有新的实例用 merge 的结果替换快照正在读的文件
+	assert.Equal(t, ErrSnapshotsOpen, db.Close())
+	_, err = Open(opts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+	_, err = os.Stat(filepath.Join(db.getMergeDirPath(), data.MergeFinishedFileName))
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		val, err := snap.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 快照关闭之后，重启时 merge 的结果生效
+	assert.Nil(t, snap.Close())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(db.getMergeDirPath())
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+	}
+	assert.Nil(t, db.Close())
+}
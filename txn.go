@@ -0,0 +1,218 @@
+package bitcask_go
+
+import (
+	"bitcask/data"
+	"bytes"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Txn 乐观读写事务
+//
+// 读取的是 Begin 时的快照，写入暂存在事务中，Get 能看到自己的写入。
+// Commit 时如果读过的 key 在 Begin 之后被其他写入修改过，返回 ErrTxnConflict，事务中的写入都不生效；
+// 否则和 WriteBatch 一样带上序列号与结束标识写入，保证原子性
+type Txn struct {
+	mu             *sync.Mutex
+	db             *DB
+	snapshot       *Snapshot
+	startVersion   uint64              // Begin 时的版本号，之后的修改版本号都比它大
+	reads          map[string]struct{} // 读过的 key
+	penddingWrites map[string]*data.LogRecord
+	done           bool
+}
+
+// Begin 开始一个事务，用完要 Commit 或者 Rollback，否则事务占用的快照不会释放
+func (db *DB) Begin() *Txn {
+	if !db.seqNoAvailable() {
+		panic("由于序列号文件不存在，已禁止使用事务功能")
+	}
+
+	// 写入在 db.mu 下记录修改的版本号，快照与起始版本号要在同一时刻取
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	txn := &Txn{
+		mu:             new(sync.Mutex),
+		db:             db,
+		snapshot:       db.snapshot(),
+		reads:          make(map[string]struct{}),
+		penddingWrites: make(map[string]*data.LogRecord),
+	}
+	db.txnMu.Lock()
+	if db.activeTxns == nil {
+		db.activeTxns = make(map[*Txn]struct{})
+		db.txnWrites = make(map[string]uint64)
+	}
+	txn.startVersion = db.txnVersion
+	db.activeTxns[txn] = struct{}{}
+	db.txnMu.Unlock()
+	return txn
+}
+
+// Get 先查事务自己的写入，再读 Begin 时的快照，读过的 key 在提交时做冲突检测
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return nil, ErrTxnClosed
+	}
+
+	if record := txn.penddingWrites[string(key)]; record != nil {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+	txn.reads[string(key)] = struct{}{}
+	return txn.snapshot.Get(key)
+}
+
+func (txn *Txn) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if txn.db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return ErrTxnClosed
+	}
+
+	// 提交之前调用方可能会复用 key、value 的内存
+	txn.penddingWrites[string(key)] = &data.LogRecord{
+		Key:   bytes.Clone(key),
+		Value: bytes.Clone(value),
+	}
+	return nil
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if txn.db.options.ReadOnly {
+		return ErrReadOnly
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return ErrTxnClosed
+	}
+
+	// 快照中没有的 key，只需要去掉事务中暂存的写入
+	if txn.snapshot.index.Get(key) == nil {
+		delete(txn.penddingWrites, string(key))
+		return nil
+	}
+	txn.penddingWrites[string(key)] = &data.LogRecord{
+		Key:  bytes.Clone(key),
+		Type: data.LogRecordDeleted,
+	}
+	return nil
+}
+
+// Commit 提交事务，读过的 key 被修改过时返回 ErrTxnConflict
+// 无论成功与否，事务都结束了
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.done {
+		return ErrTxnClosed
+	}
+	defer txn.finish()
+
+	// 只读事务读到的就是快照，不会有冲突
+	if len(txn.penddingWrites) == 0 {
+		return nil
+	}
+	db := txn.db
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	records := make([]*data.LogRecord, 0, len(txn.penddingWrites))
+	for _, record := range txn.penddingWrites {
+		records = append(records, record)
+	}
+	logRecords := txnLogRecords(records, atomic.AddUint64(&db.seqNo, 1))
+
+	return db.commitWithCheck(logRecords, db.options.SyncWrite, txn.checkConflict, func(positions []*data.LogRecordPos) error {
+		db.applyTxnRecords(records, positions)
+		return nil
+	})
+}
+
+// Rollback 放弃事务中的写入，可以重复调用
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if !txn.done {
+		txn.finish()
+	}
+}
+
+// checkConflict 读过的 key 在 Begin 之后是否被修改过，在 db.mu 下调用
+func (txn *Txn) checkConflict() error {
+	db := txn.db
+	db.txnMu.Lock()
+	defer db.txnMu.Unlock()
+	for key := range txn.reads {
+		if db.txnWrites[key] > txn.startVersion {
+			return ErrTxnConflict
+		}
+	}
+	return nil
+}
+
+// finish 结束事务，释放快照，清理不再需要的修改记录
+func (txn *Txn) finish() {
+	txn.done = true
+	txn.penddingWrites = nil
+	_ = txn.snapshot.Close()
+
+	db := txn.db
+	db.txnMu.Lock()
+	defer db.txnMu.Unlock()
+	delete(db.activeTxns, txn)
+	if len(db.activeTxns) == 0 {
+		clear(db.txnWrites)
+		return
+	}
+	// 版本号不超过所有进行中事务起始版本号的修改，不会再引起冲突
+	minVersion := uint64(math.MaxUint64)
+	for active := range db.activeTxns {
+		minVersion = min(minVersion, active.startVersion)
+	}
+	if minVersion <= txn.startVersion {
+		return
+	}
+	for key, version := range db.txnWrites {
+		if version <= minVersion {
+			delete(db.txnWrites, key)
+		}
+	}
+}
+
+// trackTxnWrites 有事务进行时，给这次写入分配一个新的版本号，记录到修改过的 key 上，在 db.mu 下调用
+func (db *DB) trackTxnWrites(logRecords []*data.LogRecord) {
+	db.txnMu.Lock()
+	defer db.txnMu.Unlock()
+	if len(db.activeTxns) == 0 {
+		return
+	}
+	db.txnVersion++
+	for _, record := range logRecords {
+		if record.Type == data.LogRecordTxnFinished {
+			continue
+		}
+		key, _ := parseLogRecordKey(record.Key)
+		db.txnWrites[string(key)] = db.txnVersion
+	}
+}
@@ -0,0 +1,221 @@
+package bitcask_go
+
+import (
+	"bitcask/utils"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Txn(t *testing.T) {
+	for _, indexType := range []IndexType{Btree, ART, BPlusTree} {
+		opts := DefaultDBOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-txn")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+		assert.Nil(t, err)
+		err = db.Put(utils.GetTestKey(2), utils.GetTestKey(2))
+		assert.Nil(t, err)
+
+		// 事务能看到自己的写入，提交之前其他人看不到
+		txn := db.Begin()
+		_, err = txn.Get(utils.GetTestKey(3))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, txn.Put(utils.GetTestKey(3), []byte("txn")))
+		val, err := txn.Get(utils.GetTestKey(3))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("txn"), val)
+		assert.Nil(t, txn.Delete(utils.GetTestKey(1)))
+		_, err = txn.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, txn.Put(utils.GetTestKey(4), []byte("txn")))
+		assert.Nil(t, txn.Delete(utils.GetTestKey(4)))
+		_, err = db.Get(utils.GetTestKey(3))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, txn.Commit())
+
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err = db.Get(utils.GetTestKey(3))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("txn"), val)
+		_, err = db.Get(utils.GetTestKey(4))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 结束之后不能再用
+		assert.Equal(t, ErrTxnClosed, txn.Commit())
+		assert.Equal(t, ErrTxnClosed, txn.Put(utils.GetTestKey(5), []byte("txn")))
+		_, err = txn.Get(utils.GetTestKey(3))
+		assert.Equal(t, ErrTxnClosed, err)
+
+		// 提交之前修改传进去的 key、value 不影响事务
+		txn = db.Begin()
+		key, value := []byte("txn-key"), []byte("txn-value")
+		assert.Nil(t, txn.Put(key, value))
+		key[0], value[0] = 'x', 'x'
+		assert.Nil(t, txn.Commit())
+		val, err = db.Get([]byte("txn-key"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("txn-value"), val)
+		assert.Nil(t, db.Delete([]byte("txn-key")))
+
+		// 回滚的写入不生效
+		txn = db.Begin()
+		assert.Nil(t, txn.Put(utils.GetTestKey(5), []byte("txn")))
+		txn.Rollback()
+		txn.Rollback()
+		_, err = db.Get(utils.GetTestKey(5))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 重启之后事务中的数据都还在
+		err = db.Close()
+		assert.Nil(t, err)
+		db, err = Open(opts)
+		assert.Nil(t, err)
+		_, err = db.Get(utils.GetTestKey(1))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err = db.Get(utils.GetTestKey(3))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("txn"), val)
+		assert.Equal(t, 2, len(db.ListKeys()))
+
+		destroyDB(db)
+	}
+}
+
+func TestDB_Txn_Conflict(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-conflict")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = db.Put(utils.GetTestKey(i), []byte("old"))
+		assert.Nil(t, err)
+	}
+
+	// 读取的是 Begin 时的快照；读过的 key 被修改，提交失败，写入都不生效
+	txn := db.Begin()
+	err = db.Put(utils.GetTestKey(0), []byte("new"))
+	assert.Nil(t, err)
+	val, err := txn.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("old"), val)
+	assert.Nil(t, txn.Put(utils.GetTestKey(10), []byte("txn")))
+	assert.Equal(t, ErrTxnConflict, txn.Commit())
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 删除、WriteBatch、其他事务的修改都会引起冲突
+	modifications := []func() error{
+		func() error { return db.Delete(utils.GetTestKey(1)) },
+		func() error {
+			wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+			_ = wb.Put(utils.GetTestKey(1), []byte("batch"))
+			return wb.Commit()
+		},
+		func() error {
+			other := db.Begin()
+			_ = other.Put(utils.GetTestKey(1), []byte("other"))
+			return other.Commit()
+		},
+	}
+	for _, modify := range modifications {
+		txn = db.Begin()
+		_, _ = txn.Get(utils.GetTestKey(1))
+		assert.Nil(t, modify())
+		assert.Nil(t, txn.Put(utils.GetTestKey(2), []byte("txn")))
+		assert.Equal(t, ErrTxnConflict, txn.Commit())
+	}
+
+	// 没读过的 key 被修改不算冲突
+	txn = db.Begin()
+	_, _ = txn.Get(utils.GetTestKey(2))
+	err = db.Put(utils.GetTestKey(1), []byte("new"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Put(utils.GetTestKey(2), []byte("txn")))
+	assert.Nil(t, txn.Commit())
+
+	// Begin 之前的修改不算冲突
+	err = db.Put(utils.GetTestKey(2), []byte("new"))
+	assert.Nil(t, err)
+	txn = db.Begin()
+	_, _ = txn.Get(utils.GetTestKey(2))
+	assert.Nil(t, txn.Put(utils.GetTestKey(2), []byte("txn")))
+	assert.Nil(t, txn.Commit())
+
+	// 冲突检测用的版本号不占用持久化的事务序列号
+	txn = db.Begin()
+	seqNo := db.seqNo
+	for i := 0; i < 10; i++ {
+		err = db.Put(utils.GetTestKey(i), []byte("new"))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, seqNo, db.seqNo)
+	txn.Rollback()
+
+	// 所有事务都结束之后不再记录修改
+	assert.Empty(t, db.txnWrites)
+	assert.Empty(t, db.activeTxns)
+}
+
+func TestDB_Txn_Concurrent(t *testing.T) {
+	opts := DefaultDBOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-concurrent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 并发地给同一个计数器加一，冲突时重试，最后的结果不会少
+	key := []byte("counter")
+	err = db.Put(key, []byte("0"))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	var conflicts int64
+	var mu sync.Mutex
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				for {
+					txn := db.Begin()
+					val, err := txn.Get(key)
+					assert.Nil(t, err)
+					n, _ := strconv.Atoi(string(val))
+					// 让其他事务有机会插进来
+					runtime.Gosched()
+					assert.Nil(t, txn.Put(key, []byte(strconv.Itoa(n+1))))
+					err = txn.Commit()
+					if err == nil {
+						break
+					}
+					assert.Equal(t, ErrTxnConflict, err)
+					mu.Lock()
+					conflicts++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "400", string(val))
+	t.Log("conflicts:", conflicts)
+	assert.Empty(t, db.txnWrites)
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirSize(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-dirsize")
+	defer os.RemoveAll(dir)
+
+	size, err := DirSize(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	err = os.WriteFile(filepath.Join(dir, "a"), make([]byte, 100), 0644)
+	assert.Nil(t, err)
+	err = os.MkdirAll(filepath.Join(dir, "sub"), os.ModePerm)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 28), 0644)
+	assert.Nil(t, err)
+
+	size, err = DirSize(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(128), size)
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-copyfile")
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	err := os.WriteFile(src, []byte("bitcask-go"), 0644)
+	assert.Nil(t, err)
+
+	dest := filepath.Join(dir, "dest")
+	err = CopyFile(src, dest)
+	assert.Nil(t, err)
+	b, err := os.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask-go"), b)
+
+	// 源文件不存在
+	err = CopyFile(filepath.Join(dir, "unknown"), dest)
+	assert.NotNil(t, err)
+}